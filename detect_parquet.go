@@ -0,0 +1,21 @@
+package main
+
+import "bytes"
+
+// parquetMagic is the 4 bytes every Apache Parquet file starts and ends with
+var parquetMagic = []byte("PAR1")
+
+// parquetDetector recognizes Apache Parquet files by their magic number, which
+// http.DetectContentType doesn't know
+type parquetDetector struct{}
+
+func (parquetDetector) Detect(path string, head []byte) (string, bool) {
+	if bytes.HasPrefix(head, parquetMagic) {
+		return "application/vnd.apache.parquet", true
+	}
+	return "", false
+}
+
+func init() {
+	RegisterTypeDetector(parquetDetector{})
+}
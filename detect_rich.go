@@ -0,0 +1,21 @@
+package main
+
+import "github.com/gabriel-vasile/mimetype"
+
+// richSniffBytes is how much of each file is read at least with the rich-types flag, which is
+// as much as the mimetype package looks at. Formats stored as zip archives, like office
+// documents, are only told apart from other archives by entries further in than 512 bytes.
+const richSniffBytes = 3072
+
+// richType returns the content type of head, the first bytes of a file, as detected by the
+// mimetype package for the rich-types flag. It knows far more formats than
+// http.DetectContentType, like office documents, archives and fonts, so it's tried before it.
+// It gives up with application/octet-stream like the standard library does, in which case the
+// standard library and the file's extension are tried as usual.
+func richType(head []byte) (string, bool) {
+	detected := mimetype.Detect(head)
+	if detected.Is("application/octet-stream") {
+		return "", false
+	}
+	return detected.String(), true
+}
@@ -2,9 +2,19 @@ module github.com/blakeashleyjr/takehome
 
 go 1.20
 
-require go.uber.org/zap v1.24.0
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gabriel-vasile/mimetype v1.4.3
+	github.com/mattn/go-sqlite3 v1.14.22
+	go.uber.org/zap v1.24.0
+	golang.org/x/term v0.13.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// longPath returns path unchanged, since only Windows limits the length of the paths it opens
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the longest path the Windows API accepts without the \\?\ prefix
+const maxPath = 260
+
+// longPath returns path in the \\?\ form Windows needs to open paths longer than MAX_PATH. The
+// os package already does this for long absolute paths, but not for relative ones, so the path
+// is made absolute first. Shorter paths, and paths that can't be made absolute, are left as is.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -1,245 +1,5640 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
+	"github.com/fsnotify/fsnotify"
+	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
+	"golang.org/x/term"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
 )
 
 // FileInfo is a struct that holds the details of each file
 type FileInfo struct {
-	Name string
-	Size int64
-	Type string
+	Name string `json:"name" yaml:"name"`
+	Size int64  `json:"size" yaml:"size"`
+	Type string `json:"type" yaml:"type"`
+	Path string `json:"path" yaml:"path"`
+	Hash string `json:"hash,omitempty" yaml:"hash,omitempty"`
+
+	// ModTime is the file's modification time in RFC3339 format, recorded with the mtime flag
+	// or when updating
+	ModTime string `json:"mod_time,omitempty" yaml:"mod_time,omitempty"`
+
+	// Mode is the file's permission bits in octal, like 0644, and UID and GID its owner's user
+	// and group IDs. They're recorded with the perms flag, and UID and GID only on Unix.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	UID  string `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID  string `json:"gid,omitempty" yaml:"gid,omitempty"`
+
+	// Charset is the charset parameter split off the Type with the split-charset flag, like
+	// utf-8, leaving only the media type in Type
+	Charset string `json:"charset,omitempty" yaml:"charset,omitempty"`
+
+	// RelPath is the path relative to the indexed directory the file was found under, recorded
+	// with the relpath flag
+	RelPath string `json:"rel_path,omitempty" yaml:"rel_path,omitempty"`
+}
+
+// listFlag is a flag that can be repeated or given a comma-separated list of values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedFlag is a flag that can be repeated, keeping each value whole unlike listFlag.
+// Empty values are dropped, the same as an unset flag.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *repeatedFlag) Set(value string) error {
+	if value != "" {
+		*r = append(*r, value)
+	}
+	return nil
+}
+
+// Exit codes, distinct for each category of failure so scripts can tell them apart
+const (
+	exitNoMatches = 1 // --count found nothing
+	exitUsage     = 2 // bad flags, the same code the flag package exits with
+	exitWalk      = 3 // a directory to index is missing or can't be walked
+	exitIndexRead = 4 // the index file can't be opened or read
+	exitWrite     = 5 // the index file or search results can't be written
+	exitFailure   = 6 // anything else
+	exitCanceled  = 7 // indexing was interrupted or timed out, leaving a partial index
+	exitExec      = 8 // the --exec command run after indexing failed
+	exitVerify    = 9 // --verify found files changed or missing since the index was created
+)
+
+// exitError is an error that ends the program with a specific exit code. Its message and
+// key-value pairs are logged by main like any other log line; an empty message logs nothing.
+type exitError struct {
+	code          int
+	msg           string
+	keysAndValues []interface{}
+}
+
+func (e *exitError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the error logged under the "error" key, if there is one, so the typed errors
+// below can still be found with errors.As once run has given them an exit code and message
+func (e *exitError) Unwrap() error {
+	for i := 0; i+1 < len(e.keysAndValues); i += 2 {
+		if key, ok := e.keysAndValues[i].(string); ok && key == "error" {
+			if err, ok := e.keysAndValues[i+1].(error); ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fail returns an exitError with the given exit code, log message and key-value pairs
+func fail(code int, msg string, keysAndValues ...interface{}) error {
+	return &exitError{code: code, msg: msg, keysAndValues: keysAndValues}
+}
+
+// WalkError is returned when walking the directory Path to index fails
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+func (e *WalkError) Error() string {
+	return "walking " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// IndexWriteError is returned when the index file at Path can't be created or written
+type IndexWriteError struct {
 	Path string
+	Err  error
+}
+
+func (e *IndexWriteError) Error() string {
+	return "writing index file " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *IndexWriteError) Unwrap() error {
+	return e.Err
+}
+
+// exitCode returns the code to exit with when run fails with err. An exitError carries its
+// own code, and the typed errors above map to the exit code of their kind of failure.
+func exitCode(err error) int {
+	var exitErr *exitError
+	var walkErr *WalkError
+	var writeErr *IndexWriteError
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.As(err, &walkErr):
+		return exitWalk
+	case errors.As(err, &writeErr):
+		return exitWrite
+	}
+	return exitFailure
+}
+
+// Build information, set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// log is a global logger that is faster and more useful than the standard logger. It discards
+// everything until main replaces it with the one the flags ask for, so code run without main,
+// like the functions called from another package or a test, never logs to a nil logger.
+var log = zap.NewNop().Sugar()
+
+// config holds the settings for a run, parsed from the command line flags
+type config struct {
+	verbose        bool
+	logFormat      string
+	quiet          bool
+	index          bool
+	searchQueries  repeatedFlag
+	ext            string
+	matchTerms     string
+	matchMode      string
+	directories    listFlag
+	ignoreCase     bool
+	useRegex       bool
+	wildcard       bool
+	normalize      bool
+	fuzzy          bool
+	sortBy         string
+	descending     bool
+	limit          int
+	offset         int
+	output         string
+	outputs        repeatedFlag
+	format         string
+	workers        int
+	retries        int
+	content        bool
+	contentAll     bool
+	field          string
+	excludes       listFlag
+	includes       listFlag
+	pathFilters    listFlag
+	pathFilterCase bool
+	skipTypes      listFlag
+	ignoreHidden   bool
+	skipEmpty      bool
+	hashFiles      bool
+	followSymlinks bool
+	absolutePaths  bool
+	relativeTo     string
+	base           string
+	minSizeFlag    string
+	maxSizeFlag    string
+	newerThanFlag  string
+	olderThanFlag  string
+	resultFormat   string
+	printColumn    string
+	stripPrefix    string
+	countOnly      bool
+	open           bool
+	yes            bool
+	dryRun         bool
+	stats          bool
+	histogram      bool
+	groupBy        string
+	groupDepth     int
+	findDupes      bool
+	findNameDupes  bool
+	dedupe         bool
+	dedupeKeep     string
+	recent         int
+	verify         bool
+	noHeader       bool
+	delimiterFlag  string
+	delimiter      rune
+	fastType       bool
+	sniffBytes     int
+	richTypes      bool
+	errorsFile     string
+	exec           string
+	perms          bool
+	mtime          bool
+	splitCharset   bool
+	relPath        bool
+	serve          bool
+	interactive    bool
+	watch          bool
+	progress       bool
+	summaryJSON    bool
+	sorted         bool
+	gzip           bool
+	metadata       bool
+	addr           string
+	timeout        time.Duration
+	maxDepth       int
+	maxFiles       int
+	human          bool
+	update         bool
+	showVersion    bool
+	configFile     string
+
+	// flagsUsed holds every flag given on the command line or in the config file, like
+	// -hash=true, for the metadata flag
+	flagsUsed []string
+
+	// minSize and maxSize are the parsed size limits in bytes, where -1 means no limit
+	minSize int64
+	maxSize int64
+
+	// indexLabel is the index file that search results are prefixed with when several are searched
+	indexLabel string
+
+	// newerThan and olderThan are the parsed modification time limits, where the zero time
+	// means no limit
+	newerThan time.Time
+	olderThan time.Time
+}
+
+// parseFlags parses the command line arguments, without the program name, into a config
+func parseFlags(args []string) (*config, error) {
+	cfg := &config{minSize: -1, maxSize: -1}
+
+	flags := flag.NewFlagSet("index-search", flag.ContinueOnError)
+	flags.BoolVar(&cfg.verbose, "v", false, "verbose output")
+	flags.BoolVar(&cfg.verbose, "verbose", false, "verbose output")
+	flags.BoolVar(&cfg.quiet, "q", false, "only log warnings and errors, overriding verbose")
+	flags.BoolVar(&cfg.quiet, "quiet", false, "only log warnings and errors, overriding verbose")
+	flags.StringVar(&cfg.logFormat, "log-format", "", "log format: console or json (default console with verbose, otherwise json)")
+	flags.BoolVar(&cfg.index, "i", false, "index files")
+	flags.BoolVar(&cfg.index, "index", false, "index files")
+	flags.Var(&cfg.searchQueries, "s", "search query (repeatable to search for several terms)")
+	flags.Var(&cfg.searchQueries, "search", "search query (repeatable to search for several terms)")
+	flags.StringVar(&cfg.ext, "ext", "", "only match files with this extension, like pdf or .pdf, ignoring case (a search of every file without -s)")
+	flags.StringVar(&cfg.matchMode, "match-mode", "substring", "how search queries match a value: substring, prefix, suffix or exact")
+	flags.StringVar(&cfg.matchTerms, "match", "", "split search queries into space-separated terms and match rows with any or all of them (default all for repeated queries)")
+	flags.Var(&cfg.directories, "d", "relative path to a directory to index (repeatable or comma-separated)")
+	flags.Var(&cfg.directories, "directory", "relative path to a directory to index (repeatable or comma-separated)")
+	flags.BoolVar(&cfg.ignoreCase, "I", false, "case-insensitive search")
+	flags.BoolVar(&cfg.ignoreCase, "ignore-case", false, "case-insensitive search")
+	flags.BoolVar(&cfg.useRegex, "regex", false, "treat the search query as a regular expression")
+	flags.BoolVar(&cfg.wildcard, "wildcard", false, "treat the search query as a shell wildcard pattern like *.log, matched against the whole value")
+	flags.BoolVar(&cfg.normalize, "normalize", false, "compare the search query and indexed values in the same Unicode normalization form (NFC)")
+	flags.BoolVar(&cfg.fuzzy, "fuzzy", false, "rank files by how closely their names match the search query, closest first")
+	flags.StringVar(&cfg.sortBy, "sort", "", "sort search results by name, size or path (default index order)")
+	flags.BoolVar(&cfg.descending, "desc", false, "with -sort, sort search results in descending order")
+	flags.IntVar(&cfg.limit, "limit", 0, "print at most this many search results (default no limit, or 10 with -fuzzy)")
+	flags.IntVar(&cfg.offset, "offset", 0, "skip this many search results before printing the rest, for paging with -limit")
+	flags.Var(&cfg.outputs, "o", "path to the index file to create or search, repeatable to search several (default ./index.csv, or ./index.<format> with -format)")
+	flags.Var(&cfg.outputs, "output", "path to the index file to create or search, repeatable to search several (default ./index.csv, or ./index.<format> with -format)")
+	flags.StringVar(&cfg.format, "f", "", "index file format: csv, json, ndjson, yaml or sqlite (default inferred from the output extension, otherwise csv)")
+	flags.StringVar(&cfg.format, "format", "", "index file format: csv, json, ndjson, yaml or sqlite (default inferred from the output extension, otherwise csv)")
+	flags.IntVar(&cfg.maxDepth, "max-depth", -1, "only index files this many directories below each directory to index, where 0 is only its own files and -1 is no limit")
+	flags.IntVar(&cfg.maxFiles, "max-files", 0, "stop with an error once the directories to index hold more than this many files, where 0 is no limit")
+	flags.StringVar(&cfg.newerThanFlag, "newer-than", "", "only index files modified after this, as a duration ago like 24h or an RFC3339 time")
+	flags.StringVar(&cfg.olderThanFlag, "older-than", "", "only index files modified before this, as a duration ago like 24h or an RFC3339 time")
+	flags.DurationVar(&cfg.timeout, "timeout", 0, "stop indexing after this long, e.g. 30s or 5m, keeping the files read so far (default no timeout)")
+	flags.IntVar(&cfg.workers, "w", runtime.NumCPU(), "number of files to read concurrently while indexing or searching contents")
+	flags.IntVar(&cfg.retries, "retries", 0, "retry reading a file this many times after an error that may be transient, with exponential backoff")
+	flags.IntVar(&cfg.workers, "workers", runtime.NumCPU(), "number of files to read concurrently while indexing or searching contents")
+	flags.BoolVar(&cfg.content, "content", false, "search the contents of indexed files instead of their names")
+	flags.BoolVar(&cfg.contentAll, "content-all", false, "include files that are not text/* or look binary in content search")
+	flags.BoolVar(&cfg.open, "open", false, "open the single best search match with the platform's default application")
+	flags.BoolVar(&cfg.yes, "yes", false, "open the match of -open without asking for confirmation")
+	flags.StringVar(&cfg.stripPrefix, "strip-prefix", "", "remove this leading string from the paths printed in search results, leaving the index as it is")
+	flags.StringVar(&cfg.printColumn, "print", "", "print only this column of each search result, one per line: name, size, type, path, hash, modtime, mode, uid, gid, charset or relpath")
+	flags.StringVar(&cfg.field, "field", "name", "index column to search: name, size, type, path, hash, modtime, mode, uid, gid, charset, relpath, category or all")
+	flags.StringVar(&cfg.resultFormat, "result-format", "plain", "search result format: plain (tab-separated), json or csv")
+	flags.BoolVar(&cfg.stats, "stats", false, "print a summary of the existing index, by type and with the largest files, instead of indexing or searching")
+	flags.BoolVar(&cfg.histogram, "histogram", false, "with -stats, also print a bar chart of file counts by top-level type, like text or image")
+	flags.StringVar(&cfg.groupBy, "group-by", "", "with -stats, also total the files by: dir, the subdirectory of the indexed directory they're in")
+	flags.IntVar(&cfg.groupDepth, "group-depth", 1, "with -group-by dir, how many levels of subdirectories to group by")
+	flags.BoolVar(&cfg.verify, "verify", false, "rehash the files under -d and report the ones changed, missing or new since the existing index was created with -hash")
+	flags.IntVar(&cfg.recent, "recent", 0, "print the N most recently modified files of the index, newest first, after indexing or from an existing index with modification times")
+	flags.BoolVar(&cfg.findNameDupes, "find-name-dupes", false, "print the names shared by files in different directories of the existing index, with their paths")
+	flags.BoolVar(&cfg.dedupe, "dedupe", false, "remove the rows of the existing index with the same path as an earlier one, rewriting it in place")
+	flags.StringVar(&cfg.dedupeKeep, "dedupe-keep", "first", "which row of each duplicated path -dedupe keeps: first or last")
+	flags.BoolVar(&cfg.findDupes, "find-dupes", false, "print the files in the existing index with identical contents, grouped by hash (needs an index built with -hash)")
+	flags.StringVar(&cfg.exec, "exec", "", "shell command to run after a successful index, with {} replaced by the index path")
+	flags.BoolVar(&cfg.metadata, "metadata", false, "record the directories indexed, the time, the tool version and the flags used at the top of a csv or json index")
+	flags.BoolVar(&cfg.gzip, "gzip", false, "gzip-compress an index written to stdout with -o -")
+	flags.BoolVar(&cfg.sorted, "sorted", false, "write the index sorted by path, so the same tree always gives the same index file")
+	flags.BoolVar(&cfg.summaryJSON, "summary-json", false, "print a JSON summary of the new index to stdout once it's written: files, bytes, skipped files, duration and output path")
+	flags.BoolVar(&cfg.progress, "progress", false, "report how many files have been indexed while indexing")
+	flags.BoolVar(&cfg.watch, "watch", false, "keep the index up to date as files change until interrupted")
+	flags.BoolVar(&cfg.interactive, "interactive", false, "load the index once and read searches from stdin, one per line, until :quit")
+	flags.BoolVar(&cfg.serve, "serve", false, "serve the index over HTTP, with GET /search?q=... and GET /stats, until interrupted")
+	flags.StringVar(&cfg.addr, "addr", ":8080", "address to listen on with -serve")
+	flags.BoolVar(&cfg.dryRun, "dry-run", false, "walk and read the files to index, printing a summary instead of writing the index")
+	flags.BoolVar(&cfg.countOnly, "count", false, "print only the number of search matches, exiting with code 1 if there are none")
+	flags.BoolVar(&cfg.human, "human", false, "print sizes in search results as human-readable units like 1.2MB (plain and csv results)")
+	flags.Var(&cfg.excludes, "e", "glob pattern of files and directories to skip while indexing (repeatable or comma-separated)")
+	flags.Var(&cfg.excludes, "exclude", "glob pattern of files and directories to skip while indexing (repeatable or comma-separated)")
+	flags.Var(&cfg.includes, "include", "only index files with one of these extensions, like go or .md (repeatable or comma-separated)")
+	flags.BoolVar(&cfg.skipEmpty, "skip-empty", false, "skip zero-byte files when indexing")
+	flags.BoolVar(&cfg.ignoreHidden, "ignore-hidden", false, "skip files and directories whose name starts with a dot, other than the directories to index")
+	flags.Var(&cfg.pathFilters, "path-filter", "only index files whose path contains one of these, like src/ (repeatable or comma-separated)")
+	flags.BoolVar(&cfg.pathFilterCase, "path-filter-ignore-case", false, "match -path-filter ignoring case")
+	flags.Var(&cfg.skipTypes, "skip-type", "leave out files whose content type starts with this, like image/ or video/mp4 (repeatable or comma-separated)")
+	flags.StringVar(&cfg.errorsFile, "errors-file", "", "write the files that couldn't be indexed, and why, to this CSV file")
+	flags.BoolVar(&cfg.noHeader, "no-header", false, "leave the header row out of a CSV index")
+	flags.StringVar(&cfg.delimiterFlag, "delimiter", ",", "field delimiter of a CSV index: a comma, tab (or \\t), semicolon or vertical bar")
+	flags.BoolVar(&cfg.richTypes, "rich-types", false, "detect types with the mimetype package, which recognizes many more formats, like office documents, archives and fonts (reads at least 3072 bytes of each file)")
+	flags.IntVar(&cfg.sniffBytes, "sniff-bytes", defaultSniffBytes, "number of bytes read from the start of each file to detect its type (detection by the standard library only looks at the first 512)")
+	flags.BoolVar(&cfg.fastType, "fast-type", false, "take the type of files with a known extension from the extension instead of reading them")
+	flags.BoolVar(&cfg.relPath, "relpath", false, "store each file's path relative to the directory it was found under in a RelPath column")
+	flags.BoolVar(&cfg.splitCharset, "split-charset", false, "store the charset of each file's type in its own Charset column, leaving the media type in Type")
+	flags.BoolVar(&cfg.mtime, "mtime", false, "store each file's modification time in RFC3339 format in the index")
+	flags.BoolVar(&cfg.perms, "perms", false, "store each file's permission bits, and on Unix its owner's user and group IDs, in the index")
+	flags.BoolVar(&cfg.hashFiles, "hash", false, "store the SHA-256 hash of each file's contents in the index")
+	flags.BoolVar(&cfg.followSymlinks, "follow-symlinks", false, "index the targets of symbolic links, walking linked directories")
+	flags.BoolVar(&cfg.update, "u", false, "update the existing index, only reading files modified since it was written")
+	flags.BoolVar(&cfg.update, "update", false, "update the existing index, only reading files modified since it was written")
+	flags.BoolVar(&cfg.absolutePaths, "absolute-paths", false, "store absolute paths in the index instead of paths relative to the working directory")
+	flags.StringVar(&cfg.relativeTo, "relative-to", "", "store paths in the index relative to this directory instead of the working directory")
+	flags.StringVar(&cfg.base, "base", "", "directory the stored paths are relative to when searching file contents")
+	flags.StringVar(&cfg.minSizeFlag, "min-size", "", "skip files smaller than this size, e.g. 500KB (applies to indexing and search)")
+	flags.StringVar(&cfg.maxSizeFlag, "max-size", "", "skip files larger than this size, e.g. 10MB (applies to indexing and search)")
+	flags.BoolVar(&cfg.showVersion, "version", false, "print version information and exit")
+	flags.StringVar(&cfg.configFile, "config", "", "read default flag values from this YAML file (default "+defaultConfigFile+" if it exists)")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Fill in the flags that weren't given from the config file, so explicit flags always win.
+	// Report a bad config file the same way the flag package reports a bad flag.
+	if err := applyConfigFile(flags, cfg.configFile); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return nil, err
+	}
+
+	// The first index file is the one created, or searched along with any others
+	if len(cfg.outputs) > 0 {
+		cfg.output = cfg.outputs[0]
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		cfg.flagsUsed = append(cfg.flagsUsed, "-"+f.Name+"="+f.Value.String())
+	})
+	return cfg, nil
+}
+
+// defaultConfigFile is the config file read when the config flag isn't given, if it exists
+const defaultConfigFile = ".index-search.yaml"
+
+// flagAliases maps the short name of each flag that has one to its long name, which is the one
+// config files use
+var flagAliases = map[string]string{
+	"d": "directory",
+	"e": "exclude",
+	"f": "format",
+	"i": "index",
+	"I": "ignore-case",
+	"o": "output",
+	"q": "quiet",
+	"s": "search",
+	"u": "update",
+	"v": "verbose",
+	"w": "workers",
+}
+
+// applyConfigFile sets the flags that weren't given on the command line from the YAML config
+// file at path, or at defaultConfigFile if path is empty and that file exists. The file maps
+// long flag names to values, with a list of values for flags that can be repeated:
+//
+//	directory: [src, docs]
+//	exclude: ["*.log", node_modules]
+//	format: json
+//	workers: 4
+//	hash: true
+func applyConfigFile(flags *flag.FlagSet, path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("can't read config file %s: %w", path, err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	// A flag given on the command line under either of its names overrides the config file
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[longFlagName(f.Name)] = true
+	})
+
+	// Go through the flags in name order so a bad config file always fails at the same one
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		long := longFlagName(name)
+		if long == "config" || flags.Lookup(long) == nil {
+			return fmt.Errorf("invalid config file %s: unknown flag %q", path, name)
+		}
+		if given[long] {
+			continue
+		}
+
+		list, ok := values[name].([]interface{})
+		if !ok {
+			list = []interface{}{values[name]}
+		}
+		for _, value := range list {
+			if err := flags.Set(long, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("invalid config file %s: invalid value %q for flag %s: %w", path, fmt.Sprint(value), name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// longFlagName returns the long name of the flag called name, which is name itself unless it's
+// a short name
+func longFlagName(name string) string {
+	if long, ok := flagAliases[name]; ok {
+		return long
+	}
+	return name
+}
+
+// newLogger creates the logger for a run. Verbose lowers the level to debug and quiet raises it
+// so only warnings and errors are logged, while format picks console or JSON output.
+func newLogger(verbose, quiet bool, format string) (*zap.SugaredLogger, error) {
+	// Decide the log level in one place. Quiet wins over verbose, since it's what pipelines
+	// that need a clean stderr ask for, so only warnings and errors are logged when both are set.
+	level := zap.InfoLevel
+	if quiet {
+		level = zap.WarnLevel
+	} else if verbose {
+		level = zap.DebugLevel
+	}
+
+	// Without a log format, verbose logs default to human-readable console output and the
+	// rest to JSON
+	if format == "" {
+		format = "json"
+		if verbose {
+			format = "console"
+		}
+	}
+
+	// Console logs use the development encoding and JSON logs the production one, at
+	// whichever level was chosen above
+	if format != "console" && format != "json" {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	cfg := zap.NewProductionConfig()
+	if format == "console" {
+		cfg.Encoding = "console"
+		cfg.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	cfg.Level.SetLevel(level)
+
+	// Verbose runs are for troubleshooting, so keep every log and add stack traces to warnings
+	if verbose {
+		cfg.Development = true
+		cfg.Sampling = nil
+	}
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Sugar(), nil
+}
+
+func main() {
+	// Parse the flags, exiting the same way the flag package would on its own. It has
+	// already printed the problem along with the usage.
+	cfg, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+
+	// There's no logger yet to report an invalid log format with, so print it like the
+	// flag package would
+	if cfg.logFormat != "" && cfg.logFormat != "console" && cfg.logFormat != "json" {
+		fmt.Fprintln(os.Stderr, "Invalid log-format flag provided. Please provide either console or json.")
+		os.Exit(exitUsage)
+	}
+	logger, err := newLogger(cfg.verbose, cfg.quiet, cfg.logFormat)
+	if err != nil {
+		panic(err)
+	}
+	log = logger
+
+	// Stop indexing on an interrupt, or once the timeout flag's duration has passed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	if err := run(ctx, cfg); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			if exitErr.msg != "" {
+				log.Errorw(exitErr.msg, exitErr.keysAndValues...)
+			}
+		} else {
+			log.Errorw("Unexpected error encountered", "error", err)
+		}
+		log.Sync()
+		os.Exit(exitCode(err))
+	}
+}
+
+// run does the work of main, returning an error rather than exiting so deferred cleanup runs.
+// Canceling ctx stops indexing early.
+func run(ctx context.Context, cfg *config) error {
+
+	// If the version flag is set, print the build information and exit before doing anything else
+	if cfg.showVersion {
+		fmt.Printf("index-search %s (commit %s, built %s)\n", version, commit, date)
+		return nil
+	}
+
+	// If the format flag is not provided, infer it from the output extension. When several
+	// index files are searched, each one's format is inferred from its own extension.
+	formatFlag := cfg.format
+	if cfg.format == "" {
+		cfg.format = inferFormat(cfg.output)
+	}
+
+	// Work out the delimiter of a CSV index, which has to be one that doesn't show up in names
+	// and paths often enough to need quoting all the time
+	delimiter, ok := csvDelimiters[cfg.delimiterFlag]
+	if !ok {
+		return fail(exitUsage, "Invalid delimiter flag provided. Please provide a comma, tab (or \\t), semicolon or vertical bar.", "delimiter", cfg.delimiterFlag)
+	}
+	cfg.delimiter = delimiter
+
+	// If the format is not one we support, return an error
+	if cfg.format != "csv" && cfg.format != "json" && cfg.format != "ndjson" && cfg.format != "yaml" && cfg.format != "sqlite" {
+		return fail(exitUsage, "Invalid format flag provided. Please provide one of csv, json, ndjson, yaml or sqlite.", "format", cfg.format)
+	}
+
+	// The metadata is written as comment lines in a CSV index and as an object around the files
+	// of a JSON index, which the other formats have no place for
+	if cfg.metadata && cfg.format != "csv" && cfg.format != "json" {
+		return fail(exitUsage, "Invalid metadata flag provided. Only a csv or json index can hold metadata.", "format", cfg.format)
+	}
+
+	// Only a CSV index has a delimiter
+	if cfg.delimiter != ',' && cfg.format != "csv" {
+		return fail(exitUsage, "Invalid delimiter flag provided. Only a CSV index can have another delimiter.", "format", cfg.format)
+	}
+
+	// A SQLite database is written and read in place, so it can't be compressed
+	if cfg.format == "sqlite" && isGzipPath(cfg.output) {
+		return fail(exitUsage, "Invalid output flag provided. A SQLite index can't be gzip-compressed.", "output", cfg.output)
+	}
+
+	// If the result format is not one we support, return an error
+	if cfg.resultFormat != "plain" && cfg.resultFormat != "json" && cfg.resultFormat != "csv" {
+		return fail(exitUsage, "Invalid result-format flag provided. Please provide one of plain, json or csv.", "resultFormat", cfg.resultFormat)
+	}
+
+	// If the print flag is set, it must name a column and results must be plain text
+	if cfg.printColumn != "" {
+		if columnIndex(header, cfg.printColumn) < 0 {
+			return fail(exitUsage, "Invalid print flag provided. Please provide one of name, size, type, path, hash, modtime, mode, uid, gid, charset or relpath.", "print", cfg.printColumn)
+		}
+		if cfg.resultFormat != "plain" {
+			return fail(exitUsage, "Invalid flags provided. The print flag can't be combined with the result-format flag.", "resultFormat", cfg.resultFormat)
+		}
+	}
+
+	// Without a header, the columns of a row are worked out from its cells, which can't tell a
+	// charset or a relative path from the other optional columns
+	if (cfg.splitCharset || cfg.relPath) && cfg.noHeader {
+		return fail(exitUsage, "Invalid flags provided. The split-charset and relpath flags can't be combined with the no-header flag.")
+	}
+
+	// Paths can be stored either absolute or relative to another directory, but not both
+	if cfg.relativeTo != "" && cfg.absolutePaths {
+		return fail(exitUsage, "Invalid flags provided. The relative-to flag can't be combined with the absolute-paths flag.")
+	}
+
+	// Opening a match needs the matching rows themselves, from a single index, and asking
+	// for confirmation reads stdin, which can't also hold the index
+	if cfg.open && (cfg.content || cfg.countOnly || cfg.serve || cfg.interactive || len(cfg.outputs) > 1) {
+		return fail(exitUsage, "Invalid open flag provided. The open flag can't be combined with the content, count, serve or interactive flags, or several index files.")
+	}
+	if cfg.open && !cfg.yes && cfg.output == stdioPath {
+		return fail(exitUsage, "Invalid open flag provided. The index can't be read from stdin while asking for confirmation on it. Please add the yes flag to open without asking.")
+	}
+
+	// If the match flag is set, it must say how the terms of the search queries are combined
+	if cfg.matchTerms != "" && cfg.matchTerms != "any" && cfg.matchTerms != "all" {
+		return fail(exitUsage, "Invalid match flag provided. Please provide either any or all.", "match", cfg.matchTerms)
+	}
+
+	// The match-mode flag says where in a value a query has to match, which regular
+	// expressions and fuzzy search decide for themselves
+	if cfg.matchMode != "substring" && cfg.matchMode != "prefix" && cfg.matchMode != "suffix" && cfg.matchMode != "exact" {
+		return fail(exitUsage, "Invalid match-mode flag provided. Please provide one of substring, prefix, suffix or exact.", "matchMode", cfg.matchMode)
+	}
+	if cfg.matchMode != "substring" && (cfg.useRegex || cfg.wildcard || cfg.fuzzy) {
+		return fail(exitUsage, "Invalid match-mode flag provided. The match-mode flag can't be combined with the regex, wildcard or fuzzy flags.", "matchMode", cfg.matchMode)
+	}
+
+	// A wildcard pattern matches a whole name, so it's another way of matching rather than
+	// something to combine with regular expressions, fuzzy ranking or lines of file contents
+	if cfg.wildcard && (cfg.useRegex || cfg.fuzzy || cfg.content) {
+		return fail(exitUsage, "Invalid wildcard flag provided. Wildcard search can't be combined with the regex, fuzzy or content flags.")
+	}
+
+	// Fuzzy matching ranks names itself, so it can't be combined with the other ways of matching
+	if cfg.fuzzy && (cfg.useRegex || cfg.content) {
+		return fail(exitUsage, "Invalid fuzzy flag provided. Fuzzy search can't be combined with the regex or content flags.")
+	}
+
+	// If the sort flag is set, it must name a column results can be sorted by. Fuzzy results
+	// are already ranked and content results are only paths, so neither can be sorted.
+	if cfg.sortBy != "" && cfg.sortBy != "name" && cfg.sortBy != "size" && cfg.sortBy != "path" {
+		return fail(exitUsage, "Invalid sort flag provided. Please provide one of name, size or path.", "sort", cfg.sortBy)
+	}
+	if cfg.sortBy != "" && (cfg.fuzzy || cfg.content) {
+		return fail(exitUsage, "Invalid sort flag provided. The sort flag can't be combined with the fuzzy or content flags.")
+	}
+
+	// If the limit is negative, no results could ever be printed
+	if cfg.limit < 0 {
+		return fail(exitUsage, "Invalid limit flag provided. Please provide a limit of at least 0.", "limit", cfg.limit)
+	}
+	if cfg.offset < 0 {
+		return fail(exitUsage, "Invalid offset flag provided. Please provide an offset of at least 0.", "offset", cfg.offset)
+	}
+
+	// If the sniff bytes isn't positive, no bytes would be read to detect types from
+	if cfg.sniffBytes < 1 {
+		return fail(exitUsage, "Invalid sniff-bytes flag provided. Please provide a number of bytes of at least 1.", "sniffBytes", cfg.sniffBytes)
+	}
+
+	// If the max files is negative, it's neither a number of files nor no limit
+	if cfg.maxFiles < 0 {
+		return fail(exitUsage, "Invalid max-files flag provided. Please provide a number of files of at least 1, or 0 for no limit.", "maxFiles", cfg.maxFiles)
+	}
+
+	// If the max depth is below -1, it's neither a depth nor no limit
+	if cfg.maxDepth < -1 {
+		return fail(exitUsage, "Invalid max-depth flag provided. Please provide a depth of at least 0, or -1 for no limit.", "maxDepth", cfg.maxDepth)
+	}
+
+	// If the number of workers is not positive, no files would ever be read
+	if cfg.workers < 1 {
+		return fail(exitUsage, "Invalid workers flag provided. Please provide a number of workers of at least 1.", "workers", cfg.workers)
+	}
+	if cfg.retries < 0 {
+		return fail(exitUsage, "Invalid retries flag provided. Please provide a number of retries of at least 0.", "retries", cfg.retries)
+	}
+
+	// If any exclude pattern is malformed, return an error rather than silently never matching
+	for _, pattern := range cfg.excludes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fail(exitUsage, "Invalid exclude pattern provided.", "pattern", pattern, "error", err)
+		}
+	}
+
+	// Lowercase the included extensions and give them a leading dot, so they can be compared
+	// with filepath.Ext however they were written
+	for i, ext := range cfg.includes {
+		cfg.includes[i] = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	}
+
+	// Lowercase the path filters once if they're matched ignoring case, so only each path has
+	// to be lowercased while walking
+	if cfg.pathFilterCase {
+		for i, filter := range cfg.pathFilters {
+			cfg.pathFilters[i] = strings.ToLower(filter)
+		}
+	}
+
+	// If size limits are provided, parse them into bytes
+	if cfg.minSizeFlag != "" {
+		size, err := parseSize(cfg.minSizeFlag)
+		if err != nil {
+			return fail(exitUsage, "Invalid min-size flag provided. Please provide a size like 500KB or 10MB.", "error", err)
+		}
+		cfg.minSize = size
+	}
+	if cfg.maxSizeFlag != "" {
+		size, err := parseSize(cfg.maxSizeFlag)
+		if err != nil {
+			return fail(exitUsage, "Invalid max-size flag provided. Please provide a size like 500KB or 10MB.", "error", err)
+		}
+		cfg.maxSize = size
+	}
+	if cfg.minSize >= 0 && cfg.maxSize >= 0 && cfg.minSize > cfg.maxSize {
+		return fail(exitUsage, "Invalid size flags provided. The min-size must not be larger than the max-size.", "minSize", cfg.minSize, "maxSize", cfg.maxSize)
+	}
+
+	// If modification time limits are provided, parse them into times
+	now := time.Now()
+	if cfg.newerThanFlag != "" {
+		limit, err := parseTimeLimit(cfg.newerThanFlag, now)
+		if err != nil {
+			return fail(exitUsage, "Invalid newer-than flag provided. Please provide a duration like 24h or an RFC3339 time.", "error", err)
+		}
+		cfg.newerThan = limit
+	}
+	if cfg.olderThanFlag != "" {
+		limit, err := parseTimeLimit(cfg.olderThanFlag, now)
+		if err != nil {
+			return fail(exitUsage, "Invalid older-than flag provided. Please provide a duration like 24h or an RFC3339 time.", "error", err)
+		}
+		cfg.olderThan = limit
+	}
+	if !cfg.newerThan.IsZero() && !cfg.olderThan.IsZero() && !cfg.newerThan.Before(cfg.olderThan) {
+		return fail(exitUsage, "Invalid time flags provided. The newer-than time must be before the older-than time.", "newerThan", cfg.newerThan, "olderThan", cfg.olderThan)
+	}
+
+	// If the output flag is not provided, default to an index file in the current directory
+	if cfg.output == "" {
+		cfg.output = "./index." + cfg.format
+	}
+
+	// If the directory flag is not provided but the index or verify flag is, return an error
+	if len(cfg.directories) == 0 && (cfg.index || cfg.verify) {
+		return fail(exitUsage, "No directory flag provided. Please provide a relative path to the directory to index with the directory flag.")
+	}
+
+	// An index can be written to stdout and read from stdin only in the formats that can be
+	// streamed. Once written to stdout, it's gone, so nothing else can read it afterwards, and
+	// nothing else can be printed alongside it.
+	if cfg.output == stdioPath && cfg.format == "sqlite" {
+		return fail(exitUsage, "Invalid output flag provided. A SQLite index can't be written to stdout or read from stdin.")
+	}
+	if cfg.output == stdioPath && cfg.index && (cfg.update || cfg.searching() || cfg.serve || cfg.interactive || cfg.watch || cfg.exec != "" || cfg.recent > 0 || cfg.summaryJSON) {
+		return fail(exitUsage, "Invalid output flag provided. An index written to stdout can't be combined with the update, search, serve, interactive, watch, exec, recent or summary-json flags.")
+	}
+	if cfg.gzip && (cfg.output != stdioPath || !cfg.index) {
+		return fail(exitUsage, "Invalid gzip flag provided. The gzip flag is only for an index written to stdout; other index files are compressed when their path ends in .gz.")
+	}
+
+	// Searches are typed in interactively, so there's nothing else to run as well, and stdin
+	// can't hold both the index and the searches
+	if cfg.interactive && (cfg.searching() || cfg.serve || cfg.stats || cfg.findDupes || cfg.findNameDupes) {
+		return fail(exitUsage, "Invalid interactive flag provided. The interactive flag can't be combined with the search, serve, stats, find-dupes or find-name-dupes flags.")
+	}
+	if cfg.interactive && cfg.output == stdioPath {
+		return fail(exitUsage, "Invalid output flag provided. The index can't be read from stdin in interactive mode, since searches are read from it.")
+	}
+
+	// The stats, find-dupes and find-name-dupes flags only read the index, so they can't be
+	// combined with indexing, searching, serving or each other
+	if cfg.stats && (cfg.index || cfg.searching() || cfg.findDupes || cfg.findNameDupes || cfg.serve) {
+		return fail(exitUsage, "Invalid stats flag provided. The stats flag can't be combined with the index, search, find-dupes, find-name-dupes or serve flags.")
+	}
+	if cfg.findDupes && (cfg.index || cfg.searching() || cfg.findNameDupes || cfg.serve) {
+		return fail(exitUsage, "Invalid find-dupes flag provided. The find-dupes flag can't be combined with the index, search, find-name-dupes or serve flags.")
+	}
+	if cfg.findNameDupes && (cfg.index || cfg.searching() || cfg.serve) {
+		return fail(exitUsage, "Invalid find-name-dupes flag provided. The find-name-dupes flag can't be combined with the index, search or serve flags.")
+	}
+
+	// The dedupe flag rewrites the existing index in place, so it needs an index file to
+	// rewrite and can't be combined with anything else that reads or writes the index
+	if cfg.dedupeKeep != "first" && cfg.dedupeKeep != "last" {
+		return fail(exitUsage, "Invalid dedupe-keep flag provided. Please provide either first or last.", "dedupeKeep", cfg.dedupeKeep)
+	}
+	if cfg.dedupe && (cfg.index || cfg.update || cfg.dryRun || cfg.searching() || cfg.serve || cfg.interactive || cfg.stats || cfg.findDupes || cfg.findNameDupes || cfg.recent > 0 || cfg.verify) {
+		return fail(exitUsage, "Invalid dedupe flag provided. The dedupe flag can't be combined with the index, update, dry-run, search, serve, interactive, stats, find-dupes, find-name-dupes, recent or verify flags.")
+	}
+	if cfg.dedupe && cfg.output == stdioPath {
+		return fail(exitUsage, "Invalid output flag provided. An index read from stdin can't be deduplicated, since there's no file to rewrite.")
+	}
+
+	// The recent flag prints its own listing of the index, after indexing or from an existing
+	// index, so it can't be combined with the other ways of reading the index
+	if cfg.recent < 0 {
+		return fail(exitUsage, "Invalid recent flag provided. The number of files must not be negative.", "recent", cfg.recent)
+	}
+	if cfg.recent > 0 && (cfg.searching() || cfg.serve || cfg.interactive || cfg.watch || cfg.stats || cfg.findDupes || cfg.findNameDupes || cfg.dryRun) {
+		return fail(exitUsage, "Invalid recent flag provided. The recent flag can't be combined with the search, serve, interactive, watch, stats, find-dupes, find-name-dupes or dry-run flags.")
+	}
+
+	// The verify flag walks the directories against the existing index without writing a new
+	// one, so it can't be combined with indexing or anything else that reads the index
+	if cfg.verify && (cfg.index || cfg.update || cfg.dryRun || cfg.searching() || cfg.serve || cfg.interactive || cfg.stats || cfg.findDupes || cfg.findNameDupes || cfg.recent > 0) {
+		return fail(exitUsage, "Invalid verify flag provided. The verify flag can't be combined with the index, update, dry-run, search, serve, interactive, stats, find-dupes, find-name-dupes or recent flags.")
+	}
+
+	// Searches come from requests when serving, so there's no search query to run as well
+	if cfg.serve && cfg.searching() {
+		return fail(exitUsage, "Invalid serve flag provided. The serve flag can't be combined with the search flag.")
+	}
+
+	// The exec command is run once the index is written, so there has to be one to write
+	if cfg.exec != "" && (!cfg.index || cfg.dryRun) {
+		return fail(exitUsage, "Invalid exec flag provided. The exec flag can only be used with the index flag, and not with the dry-run flag.")
+	}
+
+	// The JSON summary is the only thing printed to stdout, so it can be parsed as a whole
+	if cfg.summaryJSON && (!cfg.index || cfg.dryRun || cfg.searching() || cfg.serve || cfg.interactive || cfg.watch || cfg.recent > 0) {
+		return fail(exitUsage, "Invalid summary-json flag provided. The summary-json flag can only be used with the index flag, and not with the dry-run, search, serve, interactive, watch or recent flags.")
+	}
+
+	// Watching keeps the new index up to date until interrupted, so it needs the index flag
+	// and nothing can run after it
+	if cfg.watch && !cfg.index {
+		return fail(exitUsage, "Invalid watch flag provided. The watch flag can only be used with the index flag.")
+	}
+	if cfg.watch && (cfg.dryRun || cfg.searching() || cfg.serve || cfg.interactive) {
+		return fail(exitUsage, "Invalid watch flag provided. The watch flag can't be combined with the dry-run, search, serve or interactive flags.")
+	}
+
+	// Only a search can read several index files, printing each result prefixed with its index
+	if len(cfg.outputs) > 1 && (cfg.index || cfg.stats || cfg.findDupes || cfg.findNameDupes || cfg.dedupe || cfg.serve || cfg.interactive || !cfg.searching()) {
+		return fail(exitUsage, "Invalid output flag provided. Several index files can only be searched, not created, served or summarized.", "outputs", cfg.outputs)
+	}
+	if len(cfg.outputs) > 1 && cfg.resultFormat != "plain" {
+		return fail(exitUsage, "Invalid output flag provided. Several index files can only be searched with plain results.", "outputs", cfg.outputs)
+	}
+
+	// The histogram is part of the stats, so it needs the stats flag
+	if cfg.histogram && !cfg.stats {
+		return fail(exitUsage, "Invalid histogram flag provided. The histogram flag can only be used with the stats flag.")
+	}
+
+	// So are the totals by directory, which are grouped at least one level deep
+	if cfg.groupBy != "" && cfg.groupBy != "dir" {
+		return fail(exitUsage, "Invalid group-by flag provided. Please provide dir.", "groupBy", cfg.groupBy)
+	}
+	if cfg.groupBy != "" && !cfg.stats {
+		return fail(exitUsage, "Invalid group-by flag provided. The group-by flag can only be used with the stats flag.")
+	}
+	if cfg.groupDepth < 1 {
+		return fail(exitUsage, "Invalid group-depth flag provided. The depth must be at least 1.", "groupDepth", cfg.groupDepth)
+	}
+
+	// If the stats flag is set, summarize the existing index and exit
+	if cfg.stats {
+		return runStats(cfg)
+	}
+
+	// If the find-dupes flag is set, report the files in the existing index with the same contents and exit
+	if cfg.findDupes {
+		return runFindDupes(cfg)
+	}
+
+	// If the find-name-dupes flag is set, report the files in the existing index with the same name and exit
+	if cfg.findNameDupes {
+		return runFindNameDupes(cfg)
+	}
+
+	// If the dedupe flag is set, remove the duplicate rows of the existing index and exit
+	if cfg.dedupe {
+		return runDedupe(cfg)
+	}
+
+	// If the recent flag is set without the index flag, list the newest files of the existing index and exit
+	if cfg.recent > 0 && !cfg.index {
+		return runRecent(cfg)
+	}
+
+	// If the serve flag is set without the index flag, serve the existing index until interrupted
+	if cfg.serve && !cfg.index {
+		return runServe(ctx, cfg)
+	}
+
+	// If the interactive flag is set without the index flag, search the existing index interactively
+	if cfg.interactive && !cfg.index {
+		return runInteractive(cfg, os.Stdin, os.Stdout)
+	}
+
+	// If both searchQuery and index are false, return an error
+	if !cfg.searching() && !cfg.index && !cfg.verify {
+		return fail(exitUsage, "No search query or index flag provided. Please provide a search query and/or the index flag.")
+	}
+
+	// If several index files are given, search each of them in turn and exit
+	if len(cfg.outputs) > 1 {
+		return runSearchIndexes(cfg, formatFlag, cfg.searchTerms())
+	}
+
+	// If search query is provided and index is not, run the search and exit
+	if cfg.searching() && !cfg.index {
+		return runSearch(cfg, cfg.searchTerms())
+	}
+
+	// Otherwise, index the files and exit
+
+	// If the update flag is set, read the existing index so files that haven't changed since
+	// it was written can be reused without reading them again
+	previous := make(map[string]FileInfo)
+	if cfg.update {
+		columns, lines, err := readIndex(cfg.output, cfg.format, cfg.delimiter)
+		if err != nil && !os.IsNotExist(err) {
+			return fail(exitIndexRead, "Error encountered while reading the index file to update",
+				"filename", cfg.output,
+				"error", err,
+			)
+		}
+		if os.IsNotExist(err) {
+			log.Infow("No existing index file to update, indexing every file", "filename", cfg.output)
+		}
+		for _, line := range lines {
+			fileInfo := fileInfoFromRecord(columns, line)
+			previous[fileInfo.Path] = fileInfo
+		}
+	}
+
+	// Make sure every directory exists and is a directory before the index file is created, so
+	// a mistyped directory fails without truncating an existing index
+	for _, root := range cfg.directories {
+		info, err := os.Stat(root)
+		if err != nil {
+			return fail(exitWalk, "Error encountered while walking through files. Are you sure the directory exists and is correct?",
+				"directory", root,
+				"error", err,
+			)
+		}
+		if !info.IsDir() {
+			return fail(exitWalk, "Invalid directory flag provided. The path to index is a file, not a directory.", "directory", root)
+		}
+	}
+
+	// If the verify flag is set, check the files against the existing index and exit
+	if cfg.verify {
+		return runVerify(ctx, cfg)
+	}
+
+	// If the dry-run flag is set, read the files the same way but only summarize them. The
+	// index isn't written, so there's nothing new to search either.
+	if cfg.dryRun {
+		summary := newIndexSummary()
+		fileCount, skipped, err := indexFiles(ctx, cfg, cfg.directories, previous, summary.add)
+		if err := reportSkipped(cfg, fileCount, skipped); err != nil {
+			return err
+		}
+		if err != nil && !canceled(ctx, err) {
+			return walkFailed(cfg, err)
+		}
+		if err := summary.print(os.Stdout); err != nil {
+			return fail(exitWrite, "Failed to write dry run summary", "error", err)
+		}
+		if err != nil {
+			return fail(exitCanceled, "Dry run was stopped before every file was read. The summary only counts the files read so far.",
+				"error", err,
+			)
+		}
+		return nil
+	}
+
+	// Create the parent directories of the index file if they don't exist yet
+	if cfg.output != stdioPath {
+		if err := os.MkdirAll(filepath.Dir(cfg.output), 0755); err != nil {
+			return fail(exitWrite, "Error encountered while creating the index file's parent directory",
+				"filename", cfg.output,
+				"error", err,
+			)
+		}
+	}
+
+	// Create the index file
+	writer, err := createIndexWriter(cfg.output, cfg.format, cfg.indexColumns(), !cfg.noHeader, cfg.delimiter, cfg.gzip, cfg.indexMetadata())
+	if err != nil {
+		return fail(exitWrite, "Error encountered while creating the index file",
+			"filename", cfg.output,
+			"error", err,
+		)
+	}
+
+	// Walk the directories, writing the details of each file to the index as soon as it's read,
+	// so the index isn't in a stable order with several workers, or once they've all been read
+	// and sorted if the sorted flag is set. If the watch flag is set, also keep them to update
+	// as files change afterwards. Their total size is counted for the summary-json flag.
+	files := make(map[string]FileInfo)
+	var sortedFiles []FileInfo
+	var totalBytes int64
+	emit := func(fileInfo FileInfo) {
+		if cfg.sorted {
+			sortedFiles = append(sortedFiles, fileInfo)
+		} else {
+			writer.Write(fileInfo)
+		}
+		totalBytes += fileInfo.Size
+		if cfg.watch {
+			files[fileInfo.Path] = fileInfo
+		}
+	}
+	started := time.Now()
+	fileCount, skipped, err := indexFiles(ctx, cfg, cfg.directories, previous, emit)
+	duration := time.Since(started)
+
+	// The workers finish files in no particular order, so with the sorted flag they're only
+	// written now that they can be sorted
+	if cfg.sorted {
+		sort.Slice(sortedFiles, func(i, j int) bool {
+			return sortedFiles[i].Path < sortedFiles[j].Path
+		})
+		for _, fileInfo := range sortedFiles {
+			writer.Write(fileInfo)
+		}
+	}
+	if err := reportSkipped(cfg, fileCount, skipped); err != nil {
+		writer.Abort()
+		return err
+	}
+
+	// If the walk was interrupted or timed out, finish writing the files read so far so the
+	// index is left complete rather than truncated, and exit with its own code
+	if canceled(ctx, err) {
+		if err := writer.Close(); err != nil {
+			return fail(exitWrite, "Error encountered while writing to the index file",
+				"filename", cfg.output,
+				"error", err,
+			)
+		}
+		return fail(exitCanceled, "Indexing was stopped before every file was read. The index only holds the files read so far.",
+			"filename", cfg.output,
+			"fileCount", fileCount,
+			"error", err,
+		)
+	}
+
+	// If an error occurred during the walk, discard the partial index and log it
+	if err != nil {
+		writer.Abort()
+		return walkFailed(cfg, err)
+	}
+
+	// Write the rest of the index and check if any error occurred while writing
+	if err := writer.Close(); err != nil {
+		return fail(exitWrite, "Error encountered while writing to the index file",
+			"filename", cfg.output,
+			"error", err,
+		)
+	}
+
+	// Log the creation of the index file
+	log.Infow("Successfully created index file",
+		"filename", cfg.output,
+		"fileCount", fileCount,
+	)
+
+	// If the summary-json flag is set, print the same details for scripts to parse
+	if cfg.summaryJSON {
+		summary := runSummary{
+			Files:           fileCount,
+			Bytes:           totalBytes,
+			Skipped:         len(skipped),
+			DurationSeconds: duration.Seconds(),
+			Output:          cfg.output,
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			return fail(exitWrite, "Failed to write JSON summary", "error", err)
+		}
+	}
+
+	// If the exec flag is set, hand the new index to the command before anything else runs
+	if cfg.exec != "" {
+		if err := runExec(cfg.exec, cfg.output); err != nil {
+			return err
+		}
+	}
+
+	// If the search query and the index flag are provided, run the search
+	if cfg.searching() && cfg.index {
+		return runSearch(cfg, cfg.searchTerms())
+	}
+
+	// If the recent flag is set, list the newest files of the new index
+	if cfg.recent > 0 {
+		return runRecent(cfg)
+	}
+
+	// If the serve flag is set too, serve the new index
+	if cfg.serve {
+		return runServe(ctx, cfg)
+	}
+
+	// If the interactive flag is set too, search the new index interactively
+	if cfg.interactive {
+		return runInteractive(cfg, os.Stdin, os.Stdout)
+	}
+
+	// If the watch flag is set, keep the new index up to date until interrupted
+	if cfg.watch {
+		return runWatch(ctx, cfg, files)
+	}
+	return nil
+}
+
+// runVerify reads the existing index, then walks the directories the same way as indexing,
+// hashing every file. It reports the files whose hash changed, the files in the index that
+// are missing or can't be read any more, and the files that aren't in the index yet, failing
+// with exitVerify if any file changed or is missing.
+func runVerify(ctx context.Context, cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+	if columnIndex(columns, "hash") < 0 {
+		return fail(exitIndexRead, "Index file has no hashes. Create it with the hash flag to be able to verify it", "filename", cfg.output)
+	}
+	indexed := make(map[string]FileInfo, len(lines))
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		indexed[fileInfo.Path] = fileInfo
+	}
+
+	// Hash every file the same way as indexing does, keeping the ones not in the index
+	cfg.hashFiles = true
+	var changed, added []string
+	found := make(map[string]bool)
+	fileCount, skipped, err := indexFiles(ctx, cfg, cfg.directories, nil, func(fileInfo FileInfo) {
+		found[fileInfo.Path] = true
+		previous, ok := indexed[fileInfo.Path]
+		if !ok {
+			added = append(added, fileInfo.Path)
+		} else if previous.Hash != fileInfo.Hash {
+			changed = append(changed, fileInfo.Path)
+		}
+	})
+	if err := reportSkipped(cfg, fileCount, skipped); err != nil {
+		return err
+	}
+	if canceled(ctx, err) {
+		return fail(exitCanceled, "Verifying was stopped before every file was read", "error", err)
+	}
+	if err != nil {
+		return walkFailed(cfg, err)
+	}
+
+	var missing []string
+	for path := range indexed {
+		if !found[path] {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(missing)
+	sort.Strings(added)
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, section := range []struct {
+		title string
+		paths []string
+	}{
+		{"Changed", changed},
+		{"Missing", missing},
+		{"New", added},
+	} {
+		if len(section.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n", section.title)
+		for _, path := range section.paths {
+			fmt.Fprintf(out, "  %s\n", path)
+		}
+	}
+	fmt.Fprintf(out, "Verified: %d files, %d changed, %d missing, %d new\n", len(indexed), len(changed), len(missing), len(added))
+	if err := out.Flush(); err != nil {
+		return fail(exitWrite, "Failed to write verify report", "error", err)
+	}
+
+	if len(changed) > 0 || len(missing) > 0 {
+		return fail(exitVerify, "Files changed or are missing since the index was created",
+			"filename", cfg.output,
+			"changed", len(changed),
+			"missing", len(missing),
+		)
+	}
+	return nil
+}
+
+// runSummary is the summary of a run printed by the summary-json flag
+type runSummary struct {
+	Files           int     `json:"files"`
+	Bytes           int64   `json:"bytes"`
+	Skipped         int     `json:"skipped"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Output          string  `json:"output"`
+}
+
+// watchDebounce is how long watching waits after the last change before rewriting the index,
+// so a burst of changes like a checkout or a build only rewrites it once
+const watchDebounce = time.Second
+
+// runWatch keeps the index at the output path up to date with the directories until ctx is
+// canceled, by an interrupt or the timeout. files holds the details of every file in the index
+// by their stored path. Created and modified files are read again and deleted ones dropped,
+// and once the changes settle the index is rewritten atomically, the same way it was created.
+// Any changes not yet written when watching stops are written before returning.
+func runWatch(ctx context.Context, cfg *config, files map[string]FileInfo) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fail(exitFailure, "Error encountered while starting to watch for changes", "error", err)
+	}
+	defer watcher.Close()
+
+	w := &indexWatcher{
+		cfg:     cfg,
+		watcher: watcher,
+		files:   files,
+		ignores: make(map[string]ignoreRules),
+	}
+
+	// Watch every directory that was indexed, applying each root's ignore file to the
+	// paths under it the same way indexing does
+	for _, root := range cfg.directories {
+		ignore, err := loadIgnoreFile(filepath.Join(root, ignoreFileName))
+		if err != nil {
+			log.Warnw("Skipping ignore file that can't be read",
+				"file", filepath.Join(root, ignoreFileName),
+				"error", err,
+			)
+		}
+		w.ignores[root] = ignore
+		if _, err := w.addTree(root, root, false); err != nil {
+			return fail(exitWalk, "Error encountered while watching directory for changes",
+				"directory", root,
+				"error", err,
+			)
+		}
+	}
+	log.Infow("Watching for changes", "directories", cfg.directories)
+
+	// The timer is restarted by every change, so it only fires once they've settled
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			if pending {
+				return w.write()
+			}
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if w.handle(event) {
+				pending = true
+				timer.Reset(watchDebounce)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnw("Error encountered while watching for changes", "error", err)
+
+		case <-timer.C:
+			if err := w.write(); err != nil {
+				return err
+			}
+			pending = false
+		}
+	}
+}
+
+// indexWatcher updates the files of an index as the watcher reports changes to them
+type indexWatcher struct {
+	cfg     *config
+	watcher *fsnotify.Watcher
+	files   map[string]FileInfo
+	ignores map[string]ignoreRules
+}
+
+// addTree watches dir and every directory under it that isn't left out of the index, where
+// root is the indexed directory dir is under. If index is set, each file found is also read into
+// the index, for directories created while watching. It reports whether the index changed.
+func (w *indexWatcher) addTree(root, dir string, index bool) (bool, error) {
+	changed := false
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Warnw("Skipping path that can't be watched",
+				"file", path,
+				"error", err,
+			)
+			return nil
+		}
+
+		if skipPath(w.cfg, root, w.ignores[root], path, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			if err := w.watcher.Add(path); err != nil {
+				log.Warnw("Skipping directory that can't be watched",
+					"file", path,
+					"error", err,
+				)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if index {
+			if info, err := entry.Info(); err == nil && w.update(root, path, info) {
+				changed = true
+			}
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// handle updates the index for a change the watcher reported and reports whether it changed.
+// Changes to the index file itself, and to the temporary files it's written to, are ignored.
+func (w *indexWatcher) handle(event fsnotify.Event) bool {
+	root := w.rootOf(event.Name)
+	if root == "" || w.isIndexFile(event.Name) {
+		return false
+	}
+
+	// A renamed path is reported under its old name, and under its new name as created
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		return w.remove(event.Name)
+	}
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) && !(w.cfg.perms && event.Has(fsnotify.Chmod)) {
+		return false
+	}
+
+	// The path may be gone again by the time the change is seen
+	info, err := os.Lstat(event.Name)
+	if err != nil {
+		return w.remove(event.Name)
+	}
+
+	if skipPath(w.cfg, root, w.ignores[root], event.Name, info.IsDir()) {
+		return false
+	}
+	if info.IsDir() {
+		if !event.Has(fsnotify.Create) {
+			return false
+		}
+		changed, err := w.addTree(root, event.Name, true)
+		if err != nil {
+			log.Warnw("Skipping directory that can't be watched",
+				"file", event.Name,
+				"error", err,
+			)
+		}
+		return changed
+	}
+	return w.update(root, event.Name, info)
+}
+
+// update reads the file at path, found under root, into the index, or drops it from the index
+// if it's now left out by the include flag or the size or time limits, and reports whether the
+// index changed
+func (w *indexWatcher) update(root, path string, info os.FileInfo) bool {
+	key, err := storedPath(w.cfg, path)
+	if err != nil {
+		log.Warnw("Skipping file whose absolute path can't be resolved",
+			"file", path,
+			"error", err,
+		)
+		return false
+	}
+	_, indexed := w.files[key]
+
+	if (len(w.cfg.includes) > 0 && !included(path, w.cfg.includes)) || !w.cfg.pathFiltered(path) || !w.cfg.sizeInRange(info.Size()) || (w.cfg.skipEmpty && info.Size() == 0) || !w.cfg.timeInRange(info.ModTime()) {
+		delete(w.files, key)
+		return indexed
+	}
+
+	// Files that can't be read have already been logged, and are dropped like deleted ones,
+	// as are files of a type the skip-type flag leaves out
+	fileInfo, err := indexFile(w.cfg, log, root, path, info)
+	if err != nil {
+		delete(w.files, key)
+		return indexed
+	}
+	w.files[key] = fileInfo
+	log.Debugw("Updated changed file in the index", "file", path)
+	return true
+}
+
+// remove drops the file at path from the index, or every file under it if it was a directory,
+// and reports whether the index changed
+func (w *indexWatcher) remove(path string) bool {
+	key, err := storedPath(w.cfg, path)
+	if err != nil {
+		return false
+	}
+
+	changed := false
+	for stored := range w.files {
+		if stored == key || strings.HasPrefix(stored, key+string(filepath.Separator)) {
+			delete(w.files, stored)
+			log.Debugw("Removed deleted file from the index", "file", stored)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rootOf returns the indexed directory path is under, or an empty string if there's none
+func (w *indexWatcher) rootOf(path string) string {
+	for _, root := range w.cfg.directories {
+		if within(path, root) {
+			return root
+		}
+	}
+	return ""
+}
+
+// isIndexFile reports whether path is the index file, or one of the temporary files it's
+// written to first
+func (w *indexWatcher) isIndexFile(path string) bool {
+	output, err := filepath.Abs(w.cfg.output)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	return err == nil && isIndexFile(output, abs)
+}
+
+// write rewrites the index with the current files, sorted by path
+func (w *indexWatcher) write() error {
+	writer, err := createIndexWriter(w.cfg.output, w.cfg.format, w.cfg.indexColumns(), !w.cfg.noHeader, w.cfg.delimiter, w.cfg.gzip, w.cfg.indexMetadata())
+	if err != nil {
+		return fail(exitWrite, "Error encountered while creating the index file",
+			"filename", w.cfg.output,
+			"error", err,
+		)
+	}
+
+	paths := make([]string, 0, len(w.files))
+	for path := range w.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		writer.Write(w.files[path])
+	}
+
+	if err := writer.Close(); err != nil {
+		return fail(exitWrite, "Error encountered while writing to the index file",
+			"filename", w.cfg.output,
+			"error", err,
+		)
+	}
+	log.Infow("Successfully updated index file",
+		"filename", w.cfg.output,
+		"fileCount", len(paths),
+	)
+	return nil
+}
+
+// runInteractive reads the existing index into memory, then reads searches from in, one per
+// line, and writes their results to out until in ends or :quit is typed. A line starting with
+// a colon is a command that changes how the following searches match:
+//
+//	:field <column>     search this column, like the field flag
+//	:ignorecase on|off  match ignoring case or not, like the ignore-case flag
+//	:help               list the commands
+//	:quit               stop searching
+//
+// Every other line is a search, matched the same way as the search flag with the other flags.
+func runInteractive(cfg *config, in io.Reader, out io.Writer) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Commands change this copy, so the flags stay as they were given
+	session := *cfg
+	fmt.Fprintf(out, "Loaded %d files from %s. Type a search, or :help for commands.\n", len(lines), cfg.output)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			command, argument, _ := strings.Cut(strings.TrimPrefix(line, ":"), " ")
+			argument = strings.TrimSpace(argument)
+			switch command {
+			case "quit", "q":
+				return nil
+			case "help":
+				fmt.Fprintln(out, ":field <column>     search name, size, type, path, hash, modtime, mode, uid, gid, charset, relpath, category or all")
+				fmt.Fprintln(out, ":ignorecase on|off  match ignoring case or not")
+				fmt.Fprintln(out, ":quit               stop searching")
+			case "field":
+				if !validField(argument) {
+					fmt.Fprintln(out, "Invalid field. Please provide one of name, size, type, path, hash, modtime, mode, uid, gid, charset, relpath, category or all.")
+					continue
+				}
+				session.field = strings.ToLower(argument)
+				fmt.Fprintf(out, "Searching the %s field.\n", session.field)
+			case "ignorecase":
+				if argument != "on" && argument != "off" {
+					fmt.Fprintln(out, "Invalid setting. Please provide either on or off.")
+					continue
+				}
+				session.ignoreCase = argument == "on"
+				fmt.Fprintf(out, "Ignore case is %s.\n", argument)
+			default:
+				fmt.Fprintf(out, "Unknown command %q. Type :help for commands.\n", command)
+			}
+			continue
+		}
+
+		// Search with the current settings, printing the problem rather than stopping if
+		// the search can't be run, like an invalid regular expression
+		session.searchQueries = repeatedFlag{line}
+		terms := session.searchTerms()
+		match, err := termsMatcher(&session, terms)
+		if err != nil {
+			fmt.Fprintln(out, err.Error())
+			continue
+		}
+		if session.content {
+			searchContents(&session, columns, lines, match)
+			continue
+		}
+
+		results := matchRows(&session, columns, lines, terms, match)
+		if session.countOnly {
+			fmt.Fprintln(out, len(results))
+			continue
+		}
+		if err := printResults(&session, out, columns, session.limitRows(session.sortRows(columns, results))); err != nil {
+			return fail(exitWrite, "Failed to write search results", "error", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fail(exitFailure, "Failed to read search", "error", err)
+	}
+	return nil
+}
+
+// shutdownTimeout is how long the server waits for requests in progress to finish when stopping
+const shutdownTimeout = 5 * time.Second
+
+// runServe reads the existing index into memory and serves it over HTTP until ctx is canceled.
+// GET /search matches the q parameters against the field parameter, or the field flag, the
+// same way as a search from the command line and returns the results as JSON. GET /stats
+// returns the same summary as the stats flag as JSON.
+func runServe(ctx context.Context, cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Only GET is supported.")
+			return
+		}
+
+		// Search with the flags the server was started with, overridden by the request
+		query := r.URL.Query()
+		requestCfg := *cfg
+		requestCfg.searchQueries = nil
+		for _, q := range query["q"] {
+			requestCfg.searchQueries.Set(q)
+		}
+		if field := query.Get("field"); field != "" {
+			requestCfg.field = field
+		}
+
+		if len(requestCfg.searchQueries) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "No search query provided. Please provide one with the q parameter.")
+			return
+		}
+		if !validField(requestCfg.field) {
+			writeJSONError(w, http.StatusBadRequest, "Invalid field provided. Please provide one of name, size, type, path, hash, modtime, mode, uid, gid, charset, relpath, category or all.")
+			return
+		}
+
+		terms := requestCfg.searchTerms()
+		match, err := termsMatcher(&requestCfg, terms)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		results := matchRows(&requestCfg, columns, lines, terms, match)
+		results = requestCfg.limitRows(requestCfg.sortRows(columns, results))
+		files := make([]FileInfo, 0, len(results))
+		for _, line := range results {
+			files = append(files, fileInfoFromRecord(columns, line))
+		}
+		writeJSON(w, http.StatusOK, files)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Only GET is supported.")
+			return
+		}
+		writeJSON(w, http.StatusOK, computeStats(columns, lines))
+	})
+
+	// Bind the address before saying the index is being served, so an address that's already
+	// taken fails without reporting success first
+	listener, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		return fail(exitFailure, "Failed to serve index", "addr", cfg.addr, "error", err)
+	}
+	server := &http.Server{Addr: cfg.addr, Handler: mux}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	log.Infow("Serving index",
+		"filename", cfg.output,
+		"fileCount", len(lines),
+		"addr", listener.Addr().String(),
+	)
+
+	// Serve until interrupted, then let the requests in progress finish before exiting
+	select {
+	case err := <-served:
+		return fail(exitFailure, "Failed to serve index", "addr", cfg.addr, "error", err)
+	case <-ctx.Done():
+	}
+
+	log.Infow("Shutting down server", "addr", cfg.addr)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fail(exitFailure, "Failed to shut down server", "addr", cfg.addr, "error", err)
+	}
+	return nil
+}
+
+// writeJSON writes value as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnw("Failed to write response", "error", err)
+	}
+}
+
+// writeJSONError writes msg as the error of a JSON response with the given status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// reportSkipped logs a summary of the files skipped while indexing and, if the errors-file
+// flag is set, writes the list of them to it
+func reportSkipped(cfg *config, fileCount int, skipped []skippedFile) error {
+	logSkipped(fileCount, skipped)
+	if cfg.errorsFile == "" {
+		return nil
+	}
+	if err := writeSkipped(cfg.errorsFile, skipped); err != nil {
+		return fail(exitWrite, "Error encountered while writing the errors file",
+			"filename", cfg.errorsFile,
+			"error", err,
+		)
+	}
+	return nil
+}
+
+// canceled reports whether err is from ctx being canceled, rather than a failure of its own
+func canceled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && errors.Is(err, ctx.Err())
+}
+
+// indexSummary counts the files that would be written to an index, for the dry-run flag, or
+// that are in an existing index, for the stats flag
+type indexSummary struct {
+	files     int
+	bytes     int64
+	types     map[string]int
+	typeBytes map[string]int64
+}
+
+func newIndexSummary() *indexSummary {
+	return &indexSummary{types: make(map[string]int), typeBytes: make(map[string]int64)}
+}
+
+func (s *indexSummary) add(fileInfo FileInfo) {
+	s.files++
+	s.bytes += fileInfo.Size
+	s.types[fileInfo.Type]++
+	s.typeBytes[fileInfo.Type] += fileInfo.Size
+}
+
+// print writes the summary to w as one "key: value" line per total, followed by an indented
+// line per type sorted by type, so the output is the same from run to run
+func (s *indexSummary) print(w io.Writer) error {
+	types := make([]string, 0, len(s.types))
+	for contentType := range s.types {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+
+	buffered := bufio.NewWriter(w)
+	fmt.Fprintf(buffered, "files: %d\n", s.files)
+	fmt.Fprintf(buffered, "bytes: %d\n", s.bytes)
+	fmt.Fprintln(buffered, "types:")
+	for _, contentType := range types {
+		fmt.Fprintf(buffered, "  %s: %d\n", contentType, s.types[contentType])
+	}
+	return buffered.Flush()
+}
+
+// statsTop is how many types and files the stats flag lists, largest first
+const statsTop = 10
+
+// indexStats summarizes the files of an index, listing at most statsTop types and files
+type indexStats struct {
+	Files      int             `json:"files"`
+	Bytes      int64           `json:"bytes"`
+	Average    int64           `json:"average"`
+	Types      []typeStats     `json:"types"`
+	Categories []categoryStats `json:"categories"`
+	Largest    []FileInfo      `json:"largest"`
+
+	// counts holds the number of files of every type, including those not in Types
+	counts map[string]int
+}
+
+// typeStats is the number and total size of an index's files of one type
+type typeStats struct {
+	Type  string `json:"type"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// categoryStats is the number and total size of an index's files in one category
+type categoryStats struct {
+	Category string `json:"category"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// dirStats is the number and total size of an index's files under one subdirectory
+type dirStats struct {
+	Dir   string `json:"dir"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// computeDirStats returns the number and total size of the files in the rows of an index
+// under each subdirectory depth levels below the indexed directory, largest first. Paths are
+// taken from the RelPath column if the index has one, or else relative to the deepest
+// directory all the files are under. Files directly in that directory are grouped as ".".
+func computeDirStats(columns []string, lines [][]string, depth int) []dirStats {
+	files := make([]FileInfo, 0, len(lines))
+	paths := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		files = append(files, fileInfo)
+		paths = append(paths, fileInfo.Path)
+	}
+	root := commonDir(paths)
+	hasRelPath := columnIndex(columns, "relpath") >= 0
+
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, fileInfo := range files {
+		rel := fileInfo.RelPath
+		if !hasRelPath {
+			var err error
+			if rel, err = filepath.Rel(root, fileInfo.Path); err != nil {
+				rel = fileInfo.Path
+			}
+		}
+
+		// The directories of the path, cut to the grouping depth
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		parts = parts[:len(parts)-1]
+		if len(parts) > depth {
+			parts = parts[:depth]
+		}
+		dir := "."
+		if len(parts) > 0 {
+			dir = strings.Join(parts, "/")
+		}
+		counts[dir]++
+		sizes[dir] += fileInfo.Size
+	}
+
+	dirs := make([]dirStats, 0, len(counts))
+	for dir, count := range counts {
+		dirs = append(dirs, dirStats{Dir: dir, Files: count, Bytes: sizes[dir]})
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Bytes != dirs[j].Bytes {
+			return dirs[i].Bytes > dirs[j].Bytes
+		}
+		return dirs[i].Dir < dirs[j].Dir
+	})
+	return dirs
+}
+
+// commonDir returns the deepest directory that every one of paths is under, which is the
+// indexed directory for an index of a single directory
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return "."
+	}
+	dir := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for !underDir(path, dir) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
+
+// underDir reports whether path is inside dir, going by the path alone. Every relative path is
+// under ".", like filepath.Rel takes it to be.
+func underDir(path, dir string) bool {
+	if dir == "." {
+		return !filepath.IsAbs(path)
+	}
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// computeStats returns the total number and size of the files in the rows of an index, the
+// types taking up the most space, every category and the largest files
+func computeStats(columns []string, lines [][]string) indexStats {
+	summary := newIndexSummary()
+	files := make([]FileInfo, 0, len(lines))
+	categoryFiles := make(map[string]int)
+	categoryBytes := make(map[string]int64)
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		summary.add(fileInfo)
+		files = append(files, fileInfo)
+		category := fileCategory(fileInfo.Name, fileInfo.Type)
+		categoryFiles[category]++
+		categoryBytes[category] += fileInfo.Size
+	}
+
+	// There are only a few categories, so they're all listed, largest first
+	categories := make([]categoryStats, 0, len(categoryFiles))
+	for category, count := range categoryFiles {
+		categories = append(categories, categoryStats{Category: category, Files: count, Bytes: categoryBytes[category]})
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Bytes != categories[j].Bytes {
+			return categories[i].Bytes > categories[j].Bytes
+		}
+		return categories[i].Category < categories[j].Category
+	})
+
+	// Order the types by the space they take up and the files by size, largest first
+	types := make([]typeStats, 0, len(summary.types))
+	for contentType, count := range summary.types {
+		types = append(types, typeStats{Type: contentType, Files: count, Bytes: summary.typeBytes[contentType]})
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Bytes != types[j].Bytes {
+			return types[i].Bytes > types[j].Bytes
+		}
+		return types[i].Type < types[j].Type
+	})
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(types) > statsTop {
+		types = types[:statsTop]
+	}
+	if len(files) > statsTop {
+		files = files[:statsTop]
+	}
+
+	stats := indexStats{Files: summary.files, Bytes: summary.bytes, Types: types, Categories: categories, Largest: files, counts: summary.types}
+	if summary.files > 0 {
+		stats.Average = summary.bytes / int64(summary.files)
+	}
+	return stats
+}
+
+// runStats reads the existing index and prints the total number and size of its files, the
+// types taking up the most space, the categories and the largest files as aligned tables
+func runStats(cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+	stats := computeStats(columns, lines)
+
+	size := func(bytes int64) string {
+		if cfg.human {
+			return humanizeSize(bytes)
+		}
+		return strconv.FormatInt(bytes, 10)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Files\t%d\n", stats.Files)
+	fmt.Fprintf(table, "Total size\t%s\n", size(stats.Bytes))
+	fmt.Fprintf(table, "Average size\t%s\n", size(stats.Average))
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "Type\tFiles\tSize")
+	for _, typeStats := range stats.Types {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", typeStats.Type, typeStats.Files, size(typeStats.Bytes))
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "Category\tFiles\tSize")
+	for _, categoryStats := range stats.Categories {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", categoryStats.Category, categoryStats.Files, size(categoryStats.Bytes))
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "Largest files\tSize")
+	for _, fileInfo := range stats.Largest {
+		fmt.Fprintf(table, "%s\t%s\n", fileInfo.Path, size(fileInfo.Size))
+	}
+
+	if cfg.groupBy == "dir" {
+		fmt.Fprintln(table)
+		fmt.Fprintln(table, "Directory\tFiles\tSize")
+		for _, dir := range computeDirStats(columns, lines, cfg.groupDepth) {
+			fmt.Fprintf(table, "%s\t%d\t%s\n", dir.Dir, dir.Files, size(dir.Bytes))
+		}
+	}
+
+	if cfg.histogram {
+		fmt.Fprintln(table)
+		fmt.Fprintln(table, "Files by type")
+		writeHistogram(table, stats.counts)
+	}
+
+	if err := table.Flush(); err != nil {
+		return fail(exitWrite, "Failed to write index stats", "error", err)
+	}
+	return nil
+}
+
+// runFindDupes reads the existing index and prints each hash shared by more than one file,
+// followed by the paths of those files, then the bytes taken up by every copy after the first
+func runFindDupes(cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+	if len(lines) > 0 && columnIndex(columns, "hash") < 0 {
+		return fail(exitIndexRead, "Index file has no hashes to compare. Be sure to create the index with the -hash flag", "filename", cfg.output)
+	}
+
+	// Group the files by hash, in index order within each group
+	groups := make(map[string][]FileInfo)
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		if fileInfo.Hash != "" {
+			groups[fileInfo.Hash] = append(groups[fileInfo.Hash], fileInfo)
+		}
+	}
+
+	// Only keep the hashes shared by several files, the ones wasting the most space first
+	var hashes []string
+	wasted := make(map[string]int64)
+	for hash, files := range groups {
+		if len(files) > 1 {
+			hashes = append(hashes, hash)
+			wasted[hash] = files[0].Size * int64(len(files)-1)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if wasted[hashes[i]] != wasted[hashes[j]] {
+			return wasted[hashes[i]] > wasted[hashes[j]]
+		}
+		return hashes[i] < hashes[j]
+	})
+
+	var total int64
+	out := bufio.NewWriter(os.Stdout)
+	for _, hash := range hashes {
+		fmt.Fprintln(out, hash)
+		for _, fileInfo := range groups[hash] {
+			fmt.Fprintf(out, "  %s\n", fileInfo.Path)
+		}
+		total += wasted[hash]
+	}
+	wastedSize := strconv.FormatInt(total, 10) + " bytes"
+	if cfg.human {
+		wastedSize = humanizeSize(total)
+	}
+	fmt.Fprintf(out, "Wasted: %s in %d sets of duplicates\n", wastedSize, len(hashes))
+
+	if err := out.Flush(); err != nil {
+		return fail(exitWrite, "Failed to write duplicate files", "error", err)
+	}
+	return nil
+}
+
+// runFindNameDupes reads the existing index and prints each name shared by files in more than
+// one directory, followed by the paths of those files, then how many names are shared
+func runFindNameDupes(cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Group the files by name, in index order within each group. A path repeated in the index
+	// is the same file listed twice rather than another file with its name, so it's only kept
+	// once, and the directories each name is found in are counted.
+	groups := make(map[string][]FileInfo)
+	dirs := make(map[string]map[string]bool)
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		if seen[fileInfo.Path] {
+			continue
+		}
+		seen[fileInfo.Path] = true
+		groups[fileInfo.Name] = append(groups[fileInfo.Name], fileInfo)
+		if dirs[fileInfo.Name] == nil {
+			dirs[fileInfo.Name] = make(map[string]bool)
+		}
+		dirs[fileInfo.Name][filepath.Dir(fileInfo.Path)] = true
+	}
+
+	// Only keep the names found in several directories, the most common first
+	var names []string
+	files := 0
+	for name, group := range groups {
+		if len(dirs[name]) > 1 {
+			names = append(names, name)
+			files += len(group)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(groups[names[i]]) != len(groups[names[j]]) {
+			return len(groups[names[i]]) > len(groups[names[j]])
+		}
+		return names[i] < names[j]
+	})
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, name := range names {
+		fmt.Fprintln(out, name)
+		for _, fileInfo := range groups[name] {
+			fmt.Fprintf(out, "  %s\n", fileInfo.Path)
+		}
+	}
+	fmt.Fprintf(out, "Shared: %d names by %d files\n", len(names), files)
+
+	if err := out.Flush(); err != nil {
+		return fail(exitWrite, "Failed to write files with duplicate names", "error", err)
+	}
+	return nil
+}
+
+// runDedupe reads the existing index and rewrites it without the rows whose path was already
+// seen, keeping the first or last row of each path as the dedupe-keep flag says, then prints
+// how many were removed. An index without duplicates is left untouched.
+func runDedupe(cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Find the row of each path to keep, so the kept rows stay in index order
+	kept := make(map[string]int, len(lines))
+	files := make([]FileInfo, len(lines))
+	for i, line := range lines {
+		files[i] = fileInfoFromRecord(columns, line)
+		if _, seen := kept[files[i].Path]; !seen || cfg.dedupeKeep == "last" {
+			kept[files[i].Path] = i
+		}
+	}
+	removed := len(files) - len(kept)
+
+	if removed > 0 {
+		// Rewrite the index the way it was written, so only the duplicate rows change
+		layout, err := readIndexLayout(cfg.output, cfg.format, cfg.delimiter)
+		if err != nil {
+			return fail(exitIndexRead, "Failed to read index file", "filename", cfg.output, "error", err)
+		}
+		writer, err := createIndexWriter(cfg.output, cfg.format, columns, layout.header, layout.delimiter, false, layout.metadata)
+		if err != nil {
+			return fail(exitWrite, "Error encountered while creating the index file",
+				"filename", cfg.output,
+				"error", err,
+			)
+		}
+		for i, fileInfo := range files {
+			if kept[fileInfo.Path] == i {
+				writer.Write(fileInfo)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return fail(exitWrite, "Error encountered while writing to the index file",
+				"filename", cfg.output,
+				"error", err,
+			)
+		}
+	}
+
+	if _, err := fmt.Fprintf(os.Stdout, "Removed: %d duplicates, kept %d files\n", removed, len(kept)); err != nil {
+		return fail(exitWrite, "Failed to write the number of duplicates removed", "error", err)
+	}
+	return nil
+}
+
+// recentTimeLayout is how modification times are printed by the recent flag
+const recentTimeLayout = "2006-01-02 15:04:05"
+
+// recentFile is a file of the index with its parsed modification time
+type recentFile struct {
+	path    string
+	modTime time.Time
+}
+
+// before reports whether f was modified before other, so it is listed after it by the recent
+// flag. Files modified at the same time are listed by path, so the listing is always the same.
+func (f recentFile) before(other recentFile) bool {
+	if !f.modTime.Equal(other.modTime) {
+		return f.modTime.Before(other.modTime)
+	}
+	return f.path > other.path
+}
+
+// recentHeap is a min-heap of files by modification time, so the oldest of the newest files
+// kept so far is the one replaced when a newer file is found.
+type recentHeap []recentFile
+
+func (h recentHeap) Len() int           { return len(h) }
+func (h recentHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h recentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x any)        { *h = append(*h, x.(recentFile)) }
+func (h *recentHeap) Pop() any {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// runRecent reads the index and prints the cfg.recent files with the newest modification
+// times, newest first, only keeping that many files in memory while reading
+func runRecent(cfg *config) error {
+	columns, lines, err := loadIndex(cfg)
+	if err != nil {
+		return err
+	}
+	if columnIndex(columns, "modtime") < 0 {
+		return fail(exitIndexRead, "Index file has no modification times. Create it with the mtime, recent or update flag to record them", "filename", cfg.output)
+	}
+
+	newest := make(recentHeap, 0, cfg.recent)
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		modTime, err := time.Parse(time.RFC3339, fileInfo.ModTime)
+		if err != nil {
+			log.Warnw("Skipping file with an invalid modification time in index file",
+				"file", fileInfo.Path,
+				"modTime", fileInfo.ModTime,
+			)
+			continue
+		}
+		file := recentFile{path: fileInfo.Path, modTime: modTime}
+		if newest.Len() < cfg.recent {
+			heap.Push(&newest, file)
+		} else if newest[0].before(file) {
+			newest[0] = file
+			heap.Fix(&newest, 0)
+		}
+	}
+
+	// Popping the heap gives the files oldest first, so fill the listing from the end
+	files := make([]recentFile, newest.Len())
+	for i := len(files) - 1; i >= 0; i-- {
+		files[i] = heap.Pop(&newest).(recentFile)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, file := range files {
+		fmt.Fprintf(out, "%s  %s\n", file.modTime.Local().Format(recentTimeLayout), file.path)
+	}
+	if err := out.Flush(); err != nil {
+		return fail(exitWrite, "Failed to write most recently modified files", "error", err)
+	}
+	return nil
+}
+
+// histogramWidth is the number of columns of the longest bar in a histogram
+const histogramWidth = 50
+
+// writeHistogram writes a bar chart of the file counts in types, grouped by the top-level type
+// before the slash so "text/plain" and "text/html" are both counted as text. The most common
+// type has the longest bar and the rest are scaled to it.
+func writeHistogram(w io.Writer, types map[string]int) {
+	groups := make(map[string]int)
+	for contentType, count := range types {
+		group, _, _ := strings.Cut(contentType, "/")
+		if group == "" {
+			group = "unknown"
+		}
+		groups[group] += count
+	}
+
+	names := make([]string, 0, len(groups))
+	largest := 0
+	for group, count := range groups {
+		names = append(names, group)
+		if count > largest {
+			largest = count
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if groups[names[i]] != groups[names[j]] {
+			return groups[names[i]] > groups[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	for _, group := range names {
+		// Every group has at least one file, so give it at least one column to be visible
+		width := groups[group] * histogramWidth / largest
+		if width == 0 {
+			width = 1
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", group, strings.Repeat("#", width), groups[group])
+	}
+}
+
+// runSearch runs the search, failing with exitNoMatches when the count flag is set and nothing
+// matched, so shell conditionals like `if index-search --count -s foo` work naturally
+func runSearch(cfg *config, terms []string) error {
+	matches, err := search(cfg, terms)
+	if err != nil {
+		return err
+	}
+	if cfg.countOnly && matches == 0 {
+		return &exitError{code: exitNoMatches}
+	}
+	return nil
+}
+
+// runSearchIndexes runs the search against each of the index files of the output flag in turn,
+// prefixing every result with the index file it came from. formatFlag is the format flag as
+// given, and each index's format is inferred from its extension without it. An index file that
+// can't be read is skipped with a warning, unless none of them can be.
+func runSearchIndexes(cfg *config, formatFlag string, terms []string) error {
+	total, searched := 0, 0
+	for _, output := range cfg.outputs {
+		indexCfg := *cfg
+		indexCfg.output = output
+		indexCfg.indexLabel = output
+		indexCfg.format = formatFlag
+		if indexCfg.format == "" {
+			indexCfg.format = inferFormat(output)
+		}
+
+		matches, err := search(&indexCfg, terms)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) && exitErr.code == exitIndexRead {
+			log.Warnw("Skipping index file that can't be read", exitErr.keysAndValues...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		total += matches
+		searched++
+	}
+
+	if searched == 0 {
+		return fail(exitIndexRead, "None of the index files could be read", "outputs", cfg.outputs)
+	}
+	if cfg.countOnly && total == 0 {
+		return &exitError{code: exitNoMatches}
+	}
+	return nil
+}
+
+// labeled returns s prefixed with the index file it came from when several are searched, the
+// way grep prefixes its matches with the file name
+func (cfg *config) labeled(s string) string {
+	if cfg.indexLabel == "" {
+		return s
+	}
+	return cfg.indexLabel + ":" + s
+}
+
+// fileJob is a file found during the walk whose content type still needs to be detected
+type fileJob struct {
+	root  string
+	path  string
+	entry fs.DirEntry
+}
+
+// fileResult is the outcome of indexing a single file
+type fileResult struct {
+	path     string
+	fileInfo FileInfo
+	err      error
+}
+
+// skippedFile is a file or directory that couldn't be indexed, and why
+type skippedFile struct {
+	path   string
+	reason string
+	err    error
+}
+
+// skipReason sorts err, the reason a file was skipped, into a short category for the summary
+func skipReason(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not found"
+	default:
+		return "read error"
+	}
+}
+
+// logSkipped logs a summary of the files that were skipped while indexing, counted by reason,
+// so they don't go missing from the index unnoticed
+func logSkipped(fileCount int, skipped []skippedFile) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	counts := make(map[string]int)
+	var reasons []string
+	for _, file := range skipped {
+		if counts[file.reason] == 0 {
+			reasons = append(reasons, file.reason)
+		}
+		counts[file.reason]++
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+
+	summary := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[reason], reason))
+	}
+	log.Warnw("Some files couldn't be indexed and were skipped",
+		"fileCount", fileCount,
+		"skipped", len(skipped),
+		"reasons", strings.Join(summary, ", "),
+	)
+}
+
+// writeSkipped writes the files that were skipped while indexing to a CSV file at path, with
+// the path, reason and error of each one
+func writeSkipped(path string, skipped []skippedFile) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"Path", "Reason", "Error"})
+	for _, entry := range skipped {
+		writer.Write([]string{entry.path, entry.reason, entry.err.Error()})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// indexFiles walks each root recursively in turn, passing the details of every file to emit as
+// soon as they're read, and returns how many files there were. The walk itself only collects
+// paths; opening and reading the files to detect their content type is done by a pool of workers
+// since that part is I/O-bound, so files are emitted in the order they finish rather than by path.
+// Files in previous, keyed by stored path, are reused instead of read again if they haven't been
+// modified since.
+//
+// If ctx is canceled, the walk stops and the files already found are still emitted before the
+// context's error is returned.
+func indexFiles(ctx context.Context, cfg *config, roots []string, previous map[string]FileInfo, emit func(FileInfo)) (int, []skippedFile, error) {
+	jobs := make(chan fileJob)
+	results := make(chan fileResult)
+
+	// Start the workers, closing the results channel once they have all finished
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			// Tag this worker's log lines with its ID, so the lines about each file can be told
+			// apart when several workers log at once
+			log := log.With("worker", worker)
+			for job := range jobs {
+				// Only stat the file here, now that its size is actually needed
+				info, err := job.entry.Info()
+				if err != nil {
+					log.Warnw("Skipping file whose info can't be read",
+						"file", job.path,
+						"error", err,
+					)
+					results <- fileResult{path: job.path, err: err}
+					continue
+				}
+
+				// Leave out files outside the size limits without reading them
+				if !cfg.sizeInRange(info.Size()) {
+					log.Debugw("Skipping file outside the size limits",
+						"file", job.path,
+						"size", info.Size(),
+					)
+					continue
+				}
+
+				// Leave out empty files, which are usually placeholders with nothing to detect
+				if cfg.skipEmpty && info.Size() == 0 {
+					log.Debugw("Skipping empty file", "file", job.path)
+					continue
+				}
+
+				// Leave out files modified outside the time limits without reading them
+				if !cfg.timeInRange(info.ModTime()) {
+					log.Debugw("Skipping file modified outside the time limits",
+						"file", job.path,
+						"modTime", info.ModTime(),
+					)
+					continue
+				}
+
+				// Reuse the previous details of files that haven't changed, unless their type is
+				// one the skip-type flag now leaves out
+				if fileInfo, ok := unchanged(cfg, previous, job.path, info); ok && !cfg.skipsType(fileInfo.Type) {
+					log.Debugw("Reusing unchanged file from the previous index", "file", job.path)
+					// Changing permissions doesn't change the modification time, so they're
+					// always taken from the current file info rather than reused
+					if cfg.perms {
+						fileInfo.Mode, fileInfo.UID, fileInfo.GID = filePerms(info)
+					}
+					// The same file can be indexed under a different root than last time
+					if cfg.relPath {
+						fileInfo.RelPath = relativePath(job.root, job.path)
+					}
+					results <- fileResult{fileInfo: fileInfo}
+					continue
+				}
+
+				fileInfo, err := indexFile(cfg, log, job.root, job.path, info)
+				if err == errSkippedType {
+					continue
+				}
+				results <- fileResult{path: job.path, fileInfo: fileInfo, err: err}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Emit the results from a single goroutine so the workers never block on the walk and
+	// emit is never called concurrently. Files that failed have already been logged, so
+	// they're left out and the rest are kept, with the failures collected for the summary.
+	fileCount := 0
+	var skipped []skippedFile
+	var progress *progressReporter
+	if cfg.progress {
+		progress = startProgress()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for result := range results {
+			if result.err != nil {
+				skipped = append(skipped, skippedFile{path: result.path, reason: skipReason(result.err), err: result.err})
+				continue
+			}
+			emit(result.fileInfo)
+			fileCount++
+			if progress != nil {
+				progress.add(result.fileInfo.Path)
+			}
+		}
+	}()
+
+	// skip records a path the walk itself couldn't index. The results channel is only closed
+	// once the walk is over and the workers are done, so the walk can still send to it.
+	skip := func(path string, err error) {
+		results <- fileResult{path: path, err: err}
+	}
+
+	// visited holds the real paths of the directories walked so far, so that following a
+	// symlink back into one of them can't loop forever
+	visited := make(map[string]bool)
+
+	// seen holds the absolute paths of the files handed to the workers so far, so that a file
+	// under overlapping roots is only indexed once, under the path it was first found at
+	seen := make(map[string]bool)
+
+	// root is the directory being walked and ignore holds the rules of its ignore file
+	var root string
+	var ignore ignoreRules
+
+	// queued counts the files handed to the workers so far, and tooMany is set once another
+	// file is found after the max-files flag's limit has been reached
+	queued := 0
+	tooMany := false
+
+	// output is the absolute path of the index file, which is never indexed itself when it's
+	// inside one of the directories, and neither is a previous version of it
+	output, outputErr := filepath.Abs(cfg.output)
+
+	// queue hands a file to the workers unless it has already been seen, it's the index file,
+	// the include flag is set and it doesn't have one of the included extensions, or the
+	// path-filter flag is set and its path doesn't contain one of the filters
+	queue := func(path string, entry fs.DirEntry) {
+		if len(cfg.includes) > 0 && !included(path, cfg.includes) {
+			log.Debugw("Skipping file without an included extension", "file", path)
+			return
+		}
+		if !cfg.pathFiltered(path) {
+			log.Debugw("Skipping file whose path doesn't match a path filter", "file", path)
+			return
+		}
+
+		if abs, err := filepath.Abs(path); err == nil {
+			if outputErr == nil && isIndexFile(output, abs) {
+				log.Debugw("Skipping the index file", "file", path)
+				return
+			}
+			if seen[abs] {
+				log.Debugw("Skipping file already found under another directory", "file", path)
+				return
+			}
+			seen[abs] = true
+		}
+
+		if cfg.maxFiles > 0 && queued == cfg.maxFiles {
+			tooMany = true
+			return
+		}
+		queued++
+		jobs <- fileJob{root: root, path: path, entry: entry}
+	}
+
+	// walk walks dir recursively. When dir is the target of a followed symlink, display is the
+	// link's path and every file under dir is reported under it instead of under the target.
+	var walk func(dir, display string) error
+	walk = func(dir, display string) error {
+		return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			// Stop walking as soon as the context is canceled, by an interrupt or the timeout
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			// Stop walking as soon as there are more files than the max-files flag allows,
+			// rather than reading every one of them first
+			if tooMany {
+				return errTooManyFiles
+			}
+
+			if dir != display {
+				rel, relErr := filepath.Rel(dir, path)
+				if relErr == nil {
+					path = filepath.Join(display, rel)
+				}
+			}
+
+			// Walk errors on a root itself are fatal, since nothing under it could be indexed.
+			// Anywhere else, skip whatever couldn't be read and keep indexing the rest of the tree.
+			if err != nil {
+				if dir == display && path == dir {
+					log.Errorw("Error encountered while walking through files. Are you sure the directory exists and is correct?",
+						"error", err,
+					)
+					return err
+				}
+
+				log.Warnw("Skipping path that can't be walked",
+					"file", path,
+					"error", err,
+				)
+				skip(path, err)
+				if entry != nil && entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Leave out version control directories, excluded paths, ignored paths and directories
+			// deeper than the max depth, along with everything under them
+			if skipPath(cfg, root, ignore, path, entry.IsDir()) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// If the follow-symlinks flag is set, index whatever the link points to instead of the link
+			if cfg.followSymlinks && entry.Type()&fs.ModeSymlink != 0 {
+				return followSymlink(path, walk, visited, queue, skip)
+			}
+
+			// Remember each directory's real path so links pointing back to it are detected
+			if cfg.followSymlinks && entry.IsDir() {
+				if real, err := filepath.EvalSymlinks(path); err == nil {
+					visited[real] = true
+				}
+			}
+
+			// If it's not a directory, it's a file, so hand it to the workers
+			if !entry.IsDir() {
+				queue(path, entry)
+			}
+			return nil
+		})
+	}
+
+	// Walk through each of the specified directories recursively, applying the ignore file at
+	// the root of each one to the paths under it
+	var err error
+	for _, root = range roots {
+		if ignore, err = loadIgnoreFile(filepath.Join(root, ignoreFileName)); err != nil {
+			log.Warnw("Skipping ignore file that can't be read",
+				"file", filepath.Join(root, ignoreFileName),
+				"error", err,
+			)
+		}
+		if err = walk(root, root); err != nil {
+			break
+		}
+	}
+	if err == nil && tooMany {
+		err = errTooManyFiles
+	}
+	if err != nil {
+		err = &WalkError{Path: root, Err: err}
+	}
+
+	// Wait for the workers to drain the remaining jobs and for every result to be collected
+	close(jobs)
+	<-done
+	if progress != nil {
+		progress.stop()
+	}
+
+	return fileCount, skipped, err
+}
+
+// errTooManyFiles is returned by indexFiles when the directories hold more files than the
+// max-files flag allows
+var errTooManyFiles = errors.New("too many files to index")
+
+// walkFailed returns the error to exit with when indexFiles fails with err
+func walkFailed(cfg *config, err error) error {
+	var directory string
+	var walkErr *WalkError
+	if errors.As(err, &walkErr) {
+		directory = walkErr.Path
+	}
+	if errors.Is(err, errTooManyFiles) {
+		return fail(exitWalk, "Stopped walking after finding more files than the max-files flag allows. Narrow down the directory to index, exclude some of it or raise the limit.",
+			"directory", directory,
+			"maxFiles", cfg.maxFiles,
+			"error", err,
+		)
+	}
+	return fail(exitWalk, "Error encountered while walking through files",
+		"directory", directory,
+		"error", err,
+	)
+}
+
+// isIndexFile reports whether the file at the absolute path abs is the index file at the
+// absolute path output, or one of the temporary files it's written to first
+func isIndexFile(output, abs string) bool {
+	if filepath.Dir(abs) != filepath.Dir(output) {
+		return false
+	}
+	name, base := filepath.Base(abs), filepath.Base(output)
+	return name == base || (strings.HasPrefix(name, base+".") && strings.HasSuffix(name, ".tmp"))
+}
+
+// skipPath reports whether the path found under root is left out of the index, along with
+// everything under it if it's a directory. ignore holds the rules of root's ignore file.
+func skipPath(cfg *config, root string, ignore ignoreRules, path string, isDir bool) bool {
+	// Exclude version control directories, but not files like .gitignore that only share a prefix.
+	// A file with one of their names, like the .git file of a submodule, is skipped too.
+	if vcsDirs[filepath.Base(path)] {
+		return true
+	}
+
+	// Exclude anything matching an exclude pattern, along with everything under a matching directory
+	if excluded(path, cfg.excludes) {
+		log.Debugw("Excluding path matching an exclude pattern", "file", path)
+		return true
+	}
+
+	// The root itself is never skipped, even when it's hidden like . or ~/.config
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+
+	// If the ignore-hidden flag is set, exclude dotfiles and everything under dot directories
+	if cfg.ignoreHidden && strings.HasPrefix(filepath.Base(path), ".") {
+		log.Debugw("Excluding hidden path", "file", path)
+		return true
+	}
+
+	// Exclude anything the root's ignore file ignores, the same way as an exclude pattern
+	if ignore.ignores(rel, isDir) {
+		log.Debugw("Excluding path matching the ignore file", "file", path)
+		return true
+	}
+
+	// If the max-depth flag is set, don't descend into directories whose entries would be
+	// deeper than it. The root's own entries are at depth 0, and each directory adds one.
+	if cfg.maxDepth >= 0 && isDir && depth(rel) >= cfg.maxDepth {
+		log.Debugw("Skipping directory deeper than the max depth", "file", path)
+		return true
+	}
+	return false
+}
+
+// progressRefresh is how often the progress flag redraws its line on a terminal, and
+// progressLogInterval how often it logs instead when stderr isn't a terminal
+const (
+	progressRefresh     = 200 * time.Millisecond
+	progressLogInterval = 5 * time.Second
+)
+
+// progressReporter reports how many files have been indexed so far and the latest one, on a
+// line redrawn in place when stderr is a terminal, or as a periodic info log otherwise so
+// redirected output isn't filled with redraws
+type progressReporter struct {
+	mu      sync.Mutex
+	files   int
+	path    string
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startProgress starts reporting progress until stop is called
+func startProgress() *progressReporter {
+	p := &progressReporter{done: make(chan struct{}), stopped: make(chan struct{})}
+	fd := int(os.Stderr.Fd())
+	terminal := term.IsTerminal(fd)
+	interval := progressLogInterval
+	if terminal {
+		interval = progressRefresh
+	}
+
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				// Clear the progress line so the logs that follow start on a clean line
+				if terminal {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+				}
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				files, path := p.files, p.path
+				p.mu.Unlock()
+				if !terminal {
+					log.Infow("Indexing in progress", "fileCount", files, "file", path)
+					continue
+				}
+
+				// Keep the line narrower than the terminal so it's redrawn in place rather
+				// than wrapping, cutting the start of the path off if it's too long
+				line := fmt.Sprintf("Indexed %d files: ", files)
+				if width, _, err := term.GetSize(fd); err == nil && width > 0 && len(line)+len(path) >= width {
+					if keep := width - len(line) - 4; keep > 0 {
+						path = "..." + path[len(path)-keep:]
+					} else {
+						path = ""
+					}
+				}
+				fmt.Fprintf(os.Stderr, "\r\033[K%s%s", line, path)
+			}
+		}
+	}()
+	return p
+}
+
+// add counts a file as indexed
+func (p *progressReporter) add(path string) {
+	p.mu.Lock()
+	p.files++
+	p.path = path
+	p.mu.Unlock()
+}
+
+// stop stops reporting progress, waiting for the last report to finish
+func (p *progressReporter) stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+// followSymlink indexes the target of the symlink at path. A link to a file is handed to the
+// workers with the target's size, and a link to a directory is walked as if it were a directory
+// at path. Broken links and links back into an already walked directory are skipped with a warning.
+func followSymlink(path string, walk func(dir, display string) error, visited map[string]bool, queue func(path string, entry fs.DirEntry), skip func(path string, err error)) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		log.Warnw("Skipping broken symlink",
+			"file", path,
+			"error", err,
+		)
+		skip(path, err)
+		return nil
+	}
+
+	// Stat the link rather than the target so the name stays the link's own
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Warnw("Skipping symlink whose target can't be read",
+			"file", path,
+			"target", target,
+			"error", err,
+		)
+		skip(path, err)
+		return nil
+	}
+
+	if !info.IsDir() {
+		queue(path, fs.FileInfoToDirEntry(info))
+		return nil
+	}
+
+	if visited[target] {
+		log.Warnw("Skipping symlink to a directory that has already been walked, which may be a cycle",
+			"file", path,
+			"target", target,
+		)
+		return nil
+	}
+	visited[target] = true
+
+	return walk(target, path)
+}
+
+// excluded reports whether path matches any of the exclude patterns. Patterns are matched
+// against both the full path and the base name, so "*.log" and "node_modules" match at any depth.
+func excluded(path string, excludes []string) bool {
+	for _, pattern := range excludes {
+		// The patterns are validated up front, so errors can't happen here
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// vcsDirs are the names of the version control directories that are never indexed
+var vcsDirs = map[string]bool{
+	".git": true,
+	".hg":  true,
+	".svn": true,
+}
+
+// depth returns how many directories deep rel, a path relative to the root, is. An entry of
+// the root itself is at depth 0.
+func depth(rel string) int {
+	return strings.Count(filepath.Clean(rel), string(filepath.Separator))
+}
+
+// ignoreFileName is the name of the file at the root of an indexed directory whose patterns,
+// written like a .gitignore, name the paths under it to leave out of the index
+const ignoreFileName = ".indexignore"
+
+// ignoreRule is a single pattern of an ignore file
+type ignoreRule struct {
+	// segments are the pattern split on "/", each matched against one path segment with
+	// filepath.Match, where "**" matches any number of segments
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules are the rules of an ignore file in the order they were written
+type ignoreRules []ignoreRule
+
+// loadIgnoreFile reads the rules of the ignore file at path. A missing file has no rules,
+// rather than being an error, and malformed patterns are skipped with a warning.
+func loadIgnoreFile(path string) (ignoreRules, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules ignoreRules
+	for _, line := range strings.Split(string(data), "\n") {
+		// Blank lines and comments don't hold a pattern
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// Like gitignore, a pattern with a slash before its end is relative to the root,
+		// while one without matches a name at any depth
+		rule.anchored = strings.Contains(line, "/")
+		rule.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+
+		valid := line != ""
+		for _, segment := range rule.segments {
+			if _, err := filepath.Match(segment, ""); err != nil {
+				valid = false
+			}
+		}
+		if !valid {
+			log.Warnw("Skipping invalid pattern in ignore file", "file", path, "pattern", line)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ignores reports whether rel, a path relative to the root of the ignore file, is ignored. As in
+// gitignore, the last rule that matches decides, so a negated rule can re-include a path that
+// an earlier rule ignored.
+func (rules ignoreRules) ignores(rel string, isDir bool) bool {
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		matched := false
+		if rule.anchored {
+			matched = matchSegments(rule.segments, segments)
+		} else {
+			matched = matchSegments(rule.segments, segments[len(segments)-1:])
+		}
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments reports whether the path segments match the pattern segments, where a "**"
+// pattern segment matches zero or more path segments
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+	// The patterns are validated when the ignore file is read, so errors can't happen here
+	if matched, _ := filepath.Match(pattern[0], path[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// pathFiltered reports whether path contains one of the path-filter flag's fragments, or true
+// if none are given. Paths are compared with forward slashes, so a filter like src/ works the
+// same on Windows.
+func (cfg *config) pathFiltered(path string) bool {
+	if len(cfg.pathFilters) == 0 {
+		return true
+	}
+	path = filepath.ToSlash(path)
+	if cfg.pathFilterCase {
+		path = strings.ToLower(path)
+	}
+	for _, filter := range cfg.pathFilters {
+		if strings.Contains(path, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether the extension of path, ignoring case, is one of the extensions in
+// includes, which are lowercase with a leading dot
+func included(path string, includes []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, include := range includes {
+		if ext == include {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFile opens the file at path, found under the indexed directory root, and detects its
+// content type from its first bytes. It logs to log, which names the worker while indexing.
+func indexFile(cfg *config, log *zap.SugaredLogger, root, path string, info os.FileInfo) (FileInfo, error) {
+	// If the fast-type flag is set, go by the file's extension when it's a known one, so the
+	// file only needs to be read if its extension is unknown or it has to be hashed
+	var contentType, hash string
+	if cfg.fastType {
+		contentType = extensionType(path)
+	}
+	if contentType == "" || cfg.hashFiles {
+		sniffed, sum, err := readContents(cfg, log, path)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if contentType == "" {
+			contentType = sniffed
+		}
+		hash = sum
+	}
+
+	// Write types the same way whichever detector they came from
+	contentType = normalizeType(contentType)
+
+	// If the skip-type flag is set, leave out files of the skipped types now that the type is known
+	if cfg.skipsType(contentType) {
+		log.Debugw("Skipping file of a skipped type", "file", path, "type", contentType)
+		return FileInfo{}, errSkippedType
+	}
+
+	// If the relpath flag is set, record the path relative to the indexed directory
+	var relPath string
+	if cfg.relPath {
+		relPath = relativePath(root, path)
+	}
+
+	// Work out the path to store, which may differ from the path the file was found at
+	stored, err := storedPath(cfg, path)
+	if err != nil {
+		log.Warnw("Skipping file whose absolute path can't be resolved",
+			"file", path,
+			"error", err,
+		)
+		return FileInfo{}, err
+	}
+	path = stored
+
+	// If the update or recent flag is set, record the modification time to compare against
+	// next time or to list the newest files
+	var modTime string
+	if cfg.recordModTime() {
+		modTime = info.ModTime().Format(time.RFC3339)
+	}
+
+	// If the perms flag is set, record the file's permissions and owner
+	var mode, uid, gid string
+	if cfg.perms {
+		mode, uid, gid = filePerms(info)
+	}
+
+	// If the split-charset flag is set, store the charset parameter on its own so the type
+	// is only the media type, like text/plain
+	var charset string
+	if cfg.splitCharset {
+		contentType, charset = splitCharset(contentType)
+	}
+
+	// Log the file details
+	log.Debugw("Successfully indexed file",
+		"file", path,
+		"name", info.Name(),
+		"size", info.Size(),
+		"type", contentType,
+		"hash", hash,
+	)
+
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Type:    contentType,
+		Path:    path,
+		Hash:    hash,
+		ModTime: modTime,
+		Mode:    mode,
+		UID:     uid,
+		GID:     gid,
+		Charset: charset,
+		RelPath: relPath,
+	}, nil
+}
+
+// normalizeType returns contentType in lowercase with the spaces around its parameters made
+// consistent, like text/plain; charset=utf-8, so types from different sources compare equal
+func normalizeType(contentType string) string {
+	parts := strings.Split(strings.ToLower(contentType), ";")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.TrimSpace(strings.Join(parts, "; "))
+}
+
+// errSkippedType is returned by indexFile for a file of a type the skip-type flag leaves out
+var errSkippedType = errors.New("file type is skipped")
+
+// skipsType reports whether files of contentType are left out by the skip-type flag, which
+// leaves out every type starting with one of its values, once both are normalized
+func (cfg *config) skipsType(contentType string) bool {
+	contentType = normalizeType(contentType)
+	for _, prefix := range cfg.skipTypes {
+		if strings.HasPrefix(contentType, normalizeType(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// relativePath returns the path of the file at path relative to the indexed directory root, or
+// path itself if it isn't under root
+func relativePath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// splitCharset splits a content type like "text/plain; charset=utf-8" into its media type and
+// charset. A type without a charset has an empty one, and one that doesn't parse is left whole.
+func splitCharset(contentType string) (string, string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType, ""
+	}
+	return mediaType, params["charset"]
+}
+
+// defaultSniffBytes is how many bytes are read to detect a file's type without the sniff-bytes
+// flag, which is all http.DetectContentType looks at
+const defaultSniffBytes = 512
+
+// retryDelay is how long reading a file waits before its first retry with the retries flag,
+// doubling before each retry after that
+const retryDelay = 100 * time.Millisecond
+
+// readContents opens the file at path, returning the content type detected from its first
+// bytes, as many as the sniff-bytes flag says, and, if the hash flag is set, the hash of its
+// contents. Errors that may be transient, like I/O errors on a network filesystem, are retried
+// as many times as the retries flag allows, with exponential backoff. A missing file or a
+// permission error is never retried. It logs to log, like indexFile.
+func readContents(cfg *config, log *zap.SugaredLogger, path string) (string, string, error) {
+	for attempt := 0; ; attempt++ {
+		contentType, hash, message, err := tryReadContents(cfg, path)
+		if err == nil {
+			return contentType, hash, nil
+		}
+		if attempt >= cfg.retries || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			log.Warnw(message,
+				"file", path,
+				"error", err,
+			)
+			return "", "", err
+		}
+
+		delay := retryDelay << attempt
+		log.Debugw("Retrying file after an error reading it",
+			"file", path,
+			"attempt", attempt+1,
+			"delay", delay,
+			"error", err,
+		)
+		time.Sleep(delay)
+	}
+}
+
+// tryReadContents reads the file at path once for readContents. On failure, it also returns
+// the message to log if the file ends up skipped.
+func tryReadContents(cfg *config, path string) (string, string, string, error) {
+	// Open the file
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return "", "", "Skipping file that can't be opened", err
+	}
+	defer file.Close()
+
+	// Create a buffer to read the content of the file. The rich-types flag's detection needs
+	// more of the file than the standard library's to recognize formats like office documents.
+	size := cfg.sniffBytes
+	if cfg.richTypes && size < richSniffBytes {
+		size = richSniffBytes
+	}
+	buffer := make([]byte, size)
+
+	// Fill the buffer from the start of the file. Small files return
+	// io.ErrUnexpectedEOF and empty files return io.EOF, neither of which is an error here
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", "Skipping file that can't be read", err
+	}
+
+	// Attempt to detect the content type of the file using only the bytes actually read
+	contentType := detectType(path, buffer[:n], cfg.richTypes)
+
+	// If the hash flag is set, hash the bytes already read followed by the rest of the file
+	var hash string
+	if cfg.hashFiles {
+		hasher := sha256.New()
+		hasher.Write(buffer[:n])
+		if _, err := io.Copy(hasher, file); err != nil {
+			return "", "", "Skipping file that can't be hashed", err
+		}
+		hash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return contentType, hash, "", nil
+}
+
+// fileMode formats the permission bits of mode in octal the way chmod takes them, including the
+// setuid, setgid and sticky bits, like 0644 or 4755
+func fileMode(mode fs.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// extensionTypes maps common developer file extensions that the mime package doesn't know
+// about to their content types
+var extensionTypes = map[string]string{
+	".go":   "text/x-go; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+}
+
+// TypeDetector recognizes files of a format the standard library can't sniff. Detect is given
+// the path of a file and its first bytes, and returns the file's content type and true if it's
+// in the detector's format.
+type TypeDetector interface {
+	Detect(path string, head []byte) (string, bool)
+}
+
+// typeDetectors holds the registered detectors, tried in the order they were registered
+var typeDetectors []TypeDetector
+
+// RegisterTypeDetector adds detector to the ones tried before sniffing each file. Detectors are
+// read by every indexing worker without locking, so register them from an init function, like
+// the parquet detector in detect_parquet.go, rather than while indexing.
+func RegisterTypeDetector(detector TypeDetector) {
+	typeDetectors = append(typeDetectors, detector)
+}
+
+// detectType returns the content type sniffed from head, the first bytes of the file at path.
+// The registered detectors are tried first, then the mimetype package if rich is set. Sniffing
+// gives up with the generic application/octet-stream for many formats, so in that case the
+// more specific type implied by the file's extension is used if there is one.
+func detectType(path string, head []byte, rich bool) string {
+	for _, detector := range typeDetectors {
+		if contentType, ok := detector.Detect(path, head); ok {
+			return contentType
+		}
+	}
+	if rich {
+		if contentType, ok := richType(head); ok {
+			return contentType
+		}
+	}
+
+	contentType := http.DetectContentType(head)
+	if contentType != "application/octet-stream" {
+		return contentType
+	}
+
+	if extensionType := extensionType(path); extensionType != "" {
+		return extensionType
+	}
+	return contentType
+}
+
+// extensionType returns the content type implied by the extension of path, or an empty string
+// if the extension isn't a known one
+func extensionType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if extensionType := mime.TypeByExtension(ext); extensionType != "" {
+		return extensionType
+	}
+	return extensionTypes[ext]
+}
+
+// categoryExtensions maps file extensions to the friendly groups of the category field. They're
+// checked before the type, since most code and many documents are only sniffed as text/plain.
+var categoryExtensions = map[string]string{
+	".c": "code", ".cc": "code", ".cpp": "code", ".cs": "code", ".css": "code", ".go": "code",
+	".h": "code", ".html": "code", ".java": "code", ".js": "code", ".json": "code", ".kt": "code",
+	".php": "code", ".py": "code", ".rb": "code", ".rs": "code", ".sh": "code", ".sql": "code",
+	".swift": "code", ".toml": "code", ".ts": "code", ".xml": "code", ".yaml": "code", ".yml": "code",
+
+	".csv": "documents", ".doc": "documents", ".docx": "documents", ".md": "documents",
+	".odt": "documents", ".pdf": "documents", ".ppt": "documents", ".pptx": "documents",
+	".rtf": "documents", ".txt": "documents", ".xls": "documents", ".xlsx": "documents",
+
+	".7z": "archives", ".bz2": "archives", ".gz": "archives", ".rar": "archives",
+	".tar": "archives", ".tgz": "archives", ".xz": "archives", ".zip": "archives",
+}
+
+// categoryTypes maps the start of a content type to the friendly group of the category field,
+// for files whose extension isn't in categoryExtensions. The first matching prefix wins.
+var categoryTypes = []struct {
+	prefix   string
+	category string
+}{
+	{"image/", "images"},
+	{"video/", "video"},
+	{"audio/", "audio"},
+	{"application/pdf", "documents"},
+	{"application/msword", "documents"},
+	{"application/rtf", "documents"},
+	{"application/vnd.openxmlformats-officedocument", "documents"},
+	{"application/vnd.oasis.opendocument", "documents"},
+	{"application/zip", "archives"},
+	{"application/gzip", "archives"},
+	{"application/x-gzip", "archives"},
+	{"application/x-tar", "archives"},
+	{"application/x-bzip2", "archives"},
+	{"application/x-xz", "archives"},
+	{"application/x-7z-compressed", "archives"},
+	{"application/x-rar-compressed", "archives"},
+	{"application/vnd.rar", "archives"},
+	{"application/javascript", "code"},
+	{"application/json", "code"},
+	{"application/yaml", "code"},
+	{"application/toml", "code"},
+	{"text/x-", "code"},
+	{"text/html", "code"},
+	{"text/", "documents"},
+}
+
+// fileCategory returns the friendly group of a file with the given name and content type, like
+// images or code, going by its extension first and its type otherwise, or other if neither is known
+func fileCategory(name, contentType string) string {
+	if category, ok := categoryExtensions[strings.ToLower(filepath.Ext(name))]; ok {
+		return category
+	}
+	for _, categoryType := range categoryTypes {
+		if strings.HasPrefix(contentType, categoryType.prefix) {
+			return categoryType.category
+		}
+	}
+	return "other"
+}
+
+// validField reports whether field can be searched: a column an index can have, the virtual
+// category column worked out from the name and type, or all to search every column
+func validField(field string) bool {
+	return field == "all" || strings.EqualFold(field, "category") || columnIndex(header, field) >= 0
+}
+
+// within reports whether path is inside the directory dir, comparing their absolute paths
+func within(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// storedPath returns the path to store in the index for a file found at path. If the
+// absolute-paths flag is set, this is the absolute path so it resolves from any working directory.
+// If the relative-to flag is set, it's the path relative to that directory instead, so the index
+// doesn't depend on where the directory is on this machine.
+func storedPath(cfg *config, path string) (string, error) {
+	if cfg.relativeTo != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		base, err := filepath.Abs(cfg.relativeTo)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Rel(base, abs)
+	}
+	if cfg.absolutePaths {
+		return filepath.Abs(path)
+	}
+	return path, nil
+}
+
+// unchanged returns the previous details of the file found at path if its modification time
+// isn't newer than the one recorded in the previous index, so it doesn't need to be read again
+func unchanged(cfg *config, previous map[string]FileInfo, path string, info os.FileInfo) (FileInfo, bool) {
+	stored, err := storedPath(cfg, path)
+	if err != nil {
+		return FileInfo{}, false
+	}
+
+	fileInfo, ok := previous[stored]
+	if !ok {
+		return FileInfo{}, false
+	}
+
+	// A file indexed without a hash has to be read again if hashes are wanted now
+	if cfg.hashFiles && fileInfo.Hash == "" {
+		return FileInfo{}, false
+	}
+
+	// The recorded time only has second precision, so compare at the same precision
+	recorded, err := time.Parse(time.RFC3339, fileInfo.ModTime)
+	if err != nil || info.ModTime().Truncate(time.Second).After(recorded) {
+		return FileInfo{}, false
+	}
+	return fileInfo, true
+}
+
+// searching reports whether the flags that are set ask for a search, with a search query or
+// the ext flag
+func (cfg *config) searching() bool {
+	return len(cfg.searchQueries) > 0 || cfg.ext != ""
+}
+
+// searchTerms returns the terms to search for. Each search query is one term, unless the match
+// flag is set, in which case the queries are split into space-separated terms. The ext flag on
+// its own searches for an empty term, which every file matches, leaving the ext flag to pick them.
+func (cfg *config) searchTerms() []string {
+	if len(cfg.searchQueries) == 0 && cfg.ext != "" {
+		return []string{""}
+	}
+	if cfg.matchTerms == "" {
+		return cfg.searchQueries
+	}
+
+	var terms []string
+	for _, query := range cfg.searchQueries {
+		terms = append(terms, strings.Fields(query)...)
+	}
+	return terms
+}
+
+// termMatcher returns a function reporting whether a value matches query, the way the
+// match-mode flag says or, with the regex or wildcard flags, as a regular expression or shell
+// wildcard pattern
+func termMatcher(cfg *config, query string) (func(string) bool, error) {
+	query = cfg.normalized(query)
+
+	// By default, names are matched by substring
+	match := func(name string) bool {
+		return matchName(name, query, cfg.matchMode, cfg.ignoreCase)
+	}
+
+	// If the type column is searched, types are compared the way they're written to the index,
+	// so Text/Plain;charset=UTF-8 matches text/plain; charset=utf-8
+	if strings.EqualFold(cfg.field, "type") && !cfg.useRegex && !cfg.wildcard && !cfg.content {
+		query = normalizeType(query)
+		matchType := match
+		match = func(value string) bool {
+			return matchType(normalizeType(value))
+		}
+	}
+
+	// If the size column is searched, a query like >1MB or size<=500KB compares sizes instead
+	if strings.EqualFold(cfg.field, "size") && !cfg.useRegex && !cfg.wildcard && !cfg.content {
+		if compare, ok := parseSizeComparison(query); ok {
+			match = compare
+		}
+	}
+
+	// If the regex flag is set, compile the query once and match names against it instead.
+	// Combined with the ignore-case flag, the pattern is prefixed with (?i) so the regexp
+	// engine handles case folding rather than lowercasing the pattern itself.
+	if cfg.useRegex {
+		pattern := query
+		if cfg.ignoreCase {
+			pattern = "(?i)" + pattern
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fail(exitUsage, "Failed to compile search query as a regular expression",
+				"query", query,
+				"error", err,
+			)
+		}
+		match = re.MatchString
+	}
+
+	// If the wildcard flag is set, match whole values against the query as a shell pattern
+	// instead. Combined with the ignore-case flag, both sides are lowercased first.
+	if cfg.wildcard {
+		pattern := query
+		if cfg.ignoreCase {
+			pattern = strings.ToLower(pattern)
+		}
+
+		// Match only reports a malformed pattern when it gets far enough to notice, so the
+		// pattern is checked up front rather than failing silently on some values
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fail(exitUsage, "Failed to parse search query as a wildcard pattern",
+				"query", query,
+				"error", err,
+			)
+		}
+		match = func(value string) bool {
+			if cfg.ignoreCase {
+				value = strings.ToLower(value)
+			}
+			matched, _ := filepath.Match(pattern, value)
+			return matched
+		}
+	}
+
+	// If the normalize flag is set, values are normalized the same way as the query before
+	// they're matched against it
+	if cfg.normalize {
+		matchNormalized := match
+		match = func(value string) bool {
+			return matchNormalized(norm.NFC.String(value))
+		}
+	}
+	return match, nil
+}
+
+// normalized returns s in Unicode normalization form NFC if the normalize flag is set, so that
+// a name stored decomposed, as macOS does, matches a query typed precomposed and vice versa
+func (cfg *config) normalized(s string) string {
+	if !cfg.normalize {
+		return s
+	}
+	return norm.NFC.String(s)
+}
+
+// termsMatcher returns a function reporting whether a value matches the terms. It matches if
+// it matches every term, or any of them with the match flag set to any.
+func termsMatcher(cfg *config, terms []string) (func(string) bool, error) {
+	matchers := make([]func(string) bool, 0, len(terms))
+	for _, term := range terms {
+		matcher, err := termMatcher(cfg, term)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	// A query made only of spaces has no terms, and matches nothing rather than everything
+	if len(matchers) == 0 {
+		return func(string) bool { return false }, nil
+	}
+
+	matchAny := cfg.matchTerms == "any"
+	return func(value string) bool {
+		for _, matcher := range matchers {
+			if matcher(value) == matchAny {
+				return matchAny
+			}
+		}
+		return !matchAny
+	}, nil
+}
+
+func search(cfg *config, terms []string) (int, error) {
+
+	// Match each term on its own, then combine them
+	match, err := termsMatcher(cfg, terms)
+	if err != nil {
+		return 0, err
+	}
+
+	// Make sure the field flag names a column an index can have
+	if !validField(cfg.field) {
+		return 0, fail(exitUsage, "Invalid field flag provided. Please provide one of name, size, type, path, hash, modtime, mode, uid, gid, charset, relpath, category or all.", "field", cfg.field)
+	}
+
+	// Open and read the rows of the index in whichever format it was written. Plain name
+	// searches of a SQLite index let SQLite narrow the rows down instead of scanning them all.
+	// SQLite's LIKE only folds the case of ASCII letters, so case-insensitive searches for
+	// anything else are matched here instead, the same way as every other format.
+	var columns []string
+	var lines [][]string
+	queried := cfg.format == "sqlite" && strings.EqualFold(cfg.field, "name") && len(terms) == 1 && (!cfg.ignoreCase || isASCII(terms[0])) && !cfg.useRegex && !cfg.wildcard && !cfg.content && !cfg.fuzzy && !cfg.normalize
+	if queried {
+		columns, lines, err = querySQLiteIndex(cfg.output, terms[0], cfg.matchMode, cfg.ignoreCase)
+		if err != nil {
+			err = indexReadError(cfg, err)
+		}
+	} else {
+		columns, lines, err = loadIndex(cfg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if the lines slice is empty, which for a queried index only means nothing matched
+	if len(lines) == 0 && !queried {
+		log.Warnw("Index file is empty.", "filename", cfg.output)
+		if cfg.countOnly {
+			fmt.Println(cfg.labeled("0"))
+		}
+		return 0, nil
+	}
+
+	// If the ext flag is set, only files with its extension are searched
+	if cfg.ext != "" {
+		lines = filterExt(columns, lines, cfg.ext)
+	}
+
+	// If the content flag is set, search inside the indexed files instead of their names
+	if cfg.content {
+		return searchContents(cfg, columns, lines, match), nil
+	}
+
+	return printMatches(cfg, columns, matchRows(cfg, columns, lines, terms, match))
+}
+
+// matchRows returns the rows of an index with the chosen field matching and within the size
+// limits. With the fuzzy flag, it instead returns the rows within the size limits ranked by
+// how closely their names match the terms.
+func matchRows(cfg *config, columns []string, lines [][]string, terms []string, match func(string) bool) [][]string {
+	// If the fuzzy flag is set, rank the rows within the size limits by name instead of filtering them
+	sizeColumn := columnIndex(columns, "size")
+	if cfg.fuzzy {
+		var candidates [][]string
+		for _, line := range lines {
+			if cfg.rowInSizeRange(line, sizeColumn) {
+				candidates = append(candidates, line)
+			}
+		}
+		return rankFuzzy(candidates, columnIndex(columns, "name"), strings.Join(terms, " "), cfg.normalized)
+	}
+
+	// The category isn't stored, so it's worked out from the name and type of each row
+	if strings.EqualFold(cfg.field, "category") {
+		nameColumn, typeColumn := columnIndex(columns, "name"), columnIndex(columns, "type")
+		var results [][]string
+		for _, line := range lines {
+			if nameColumn < 0 || typeColumn < 0 || len(line) <= nameColumn || len(line) <= typeColumn {
+				continue
+			}
+			if match(fileCategory(line[nameColumn], line[typeColumn])) && cfg.rowInSizeRange(line, sizeColumn) {
+				results = append(results, line)
+			}
+		}
+		return results
+	}
+
+	// Look up the column the field flag refers to in this index, where -1 means every column.
+	// An index without the column, like one built without hashes, has nothing to match.
+	column := -1
+	if cfg.field != "all" {
+		column = columnIndex(columns, cfg.field)
+		if column < 0 {
+			return nil
+		}
+	}
+
+	// Collect the matching rows so formats that wrap every result, like JSON, can be written at once
+	var results [][]string
+	for _, line := range lines {
+		if matchRow(line, column, match) && cfg.rowInSizeRange(line, sizeColumn) {
+			results = append(results, line)
+		}
+	}
+	return results
+}
+
+// filterExt returns the rows in lines whose Name has the extension ext, which is compared
+// ignoring case and with or without its leading dot
+func filterExt(columns []string, lines [][]string, ext string) [][]string {
+	nameColumn := columnIndex(columns, "name")
+	if nameColumn < 0 {
+		return nil
+	}
+
+	ext = "." + strings.TrimPrefix(ext, ".")
+	var filtered [][]string
+	for _, line := range lines {
+		if nameColumn < len(line) && strings.EqualFold(filepath.Ext(line[nameColumn]), ext) {
+			filtered = append(filtered, line)
+		}
+	}
+	return filtered
+}
+
+// printMatches prints the number of matching rows if the count flag is set, otherwise the rows
+// themselves up to the limit, and returns the number of matches
+func printMatches(cfg *config, columns []string, results [][]string) (int, error) {
+	if cfg.countOnly {
+		fmt.Println(cfg.labeled(strconv.Itoa(len(results))))
+		return len(results), nil
+	}
+
+	page := cfg.limitRows(cfg.sortRows(columns, results))
+	if err := printResults(cfg, os.Stdout, columns, page); err != nil {
+		return 0, fail(exitWrite, "Failed to write search results", "error", err)
+	}
+
+	// Say how many matched in all when only some are printed. Fuzzy search ranks every file,
+	// so there's no total worth noting.
+	if len(page) < len(results) && !cfg.fuzzy {
+		log.Infow("Printed only some of the matching results",
+			"printed", len(page),
+			"offset", cfg.offset,
+			"total", len(results),
+		)
+	}
+
+	// If the open flag is set, open the best of the printed matches
+	if cfg.open {
+		return len(results), openMatch(cfg, columns, page, os.Stdin)
+	}
+	return len(results), nil
+}
+
+// openMatch opens the file of the best of the printed results with the platform's default
+// application, asking for confirmation on stderr and reading the answer from in unless the yes
+// flag is set. Fuzzy results are ranked, so the first is the best; otherwise there has to be
+// exactly one result, since there's no telling which of several is wanted.
+func openMatch(cfg *config, columns []string, results [][]string, in io.Reader) error {
+	if len(results) == 0 {
+		return fail(exitNoMatches, "No matching file to open")
+	}
+	if len(results) > 1 && !cfg.fuzzy {
+		return fail(exitFailure, "Several files matched, so there's no single one to open. Please narrow the search, or pick one with the sort and limit flags.",
+			"matches", len(results),
+		)
+	}
+
+	path := fileInfoFromRecord(columns, results[0]).Path
+	if path == "" {
+		return fail(exitFailure, "The matching file has no path to open")
+	}
+	if cfg.base != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.base, path)
+	}
+
+	if !cfg.yes {
+		fmt.Fprintf(os.Stderr, "Open %s? [y/N] ", path)
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			log.Infow("Not opening the matching file", "file", path)
+			return nil
+		}
+	}
+
+	opener := openerCommand(path)
+	opener.Stderr = os.Stderr
+	if err := opener.Run(); err != nil {
+		return fail(exitFailure, "Failed to open the matching file", "file", path, "error", err)
+	}
+	return nil
+}
+
+// runExec runs command through the shell after the index at path has been written, with {}
+// replaced by the quoted path and the path also in the INDEX_SEARCH_FILE environment variable.
+// Its output goes to stdout and stderr, and a non-zero exit status fails with exitExec.
+func runExec(command, path string) error {
+	hook := shellCommand(command, path)
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	hook.Env = append(os.Environ(), "INDEX_SEARCH_FILE="+path)
+
+	log.Infow("Running command after indexing", "command", command)
+	if err := hook.Run(); err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return fail(exitExec, "Command run after indexing failed",
+			"command", command,
+			"exitCode", exitCode,
+			"error", err,
+		)
+	}
+	log.Infow("Command run after indexing succeeded", "command", command, "exitCode", 0)
+	return nil
+}
+
+// shellCommand returns the command that runs command in the platform's shell, with every {}
+// replaced by path quoted for that shell
+func shellCommand(command, path string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/c", strings.ReplaceAll(command, "{}", `"`+path+`"`))
+	}
+	quoted := "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+	return exec.Command("sh", "-c", strings.ReplaceAll(command, "{}", quoted))
+}
+
+// openerCommand returns the command that opens path with the platform's default application
+func openerCommand(path string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", path)
+	case "windows":
+		// start is built into cmd, and takes its first quoted argument as the window title
+		return exec.Command("cmd", "/c", "start", "", path)
+	default:
+		return exec.Command("xdg-open", path)
+	}
+}
+
+// printResults writes the matching rows, which have the given columns, to w in the format
+// chosen by the result-format flag, or only the column chosen by the print flag
+func printResults(cfg *config, w io.Writer, columns []string, results [][]string) error {
+	// Sizes stay numbers in JSON results, so only the text formats are humanized
+	if cfg.human && cfg.resultFormat != "json" {
+		results = humanizeRows(results, columnIndex(columns, "size"))
+	}
+
+	// Long stored paths are shortened for display only, after the rows have been matched
+	if cfg.stripPrefix != "" {
+		results = stripPathPrefix(results, columnIndex(columns, "path"), cfg.stripPrefix)
+	}
+
+	// Print only the chosen column, leaving an empty line for rows without it
+	if cfg.printColumn != "" {
+		column := columnIndex(columns, cfg.printColumn)
+		for _, line := range results {
+			value := ""
+			if column >= 0 && column < len(line) {
+				value = line[column]
+			}
+			if _, err := fmt.Fprintln(w, cfg.labeled(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch cfg.resultFormat {
+	case "json":
+		// Write the same objects as a JSON index, and an empty array rather than null
+		files := make([]FileInfo, 0, len(results))
+		for _, line := range results {
+			files = append(files, fileInfoFromRecord(columns, line))
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(files)
+
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(columns)
+		for _, line := range results {
+			writer.Write(line)
+		}
+		writer.Flush()
+		return writer.Error()
+
+	default:
+		for _, line := range results {
+			if _, err := fmt.Fprintln(w, cfg.labeled(strings.Join(line, "\t"))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// sortRows sorts results by the column the sort flag names, in descending order with the desc
+// flag, keeping rows that compare equal in index order. Sizes are compared as numbers, and rows
+// without a valid size sort before every other row. Without the sort flag, results are left as
+// they are.
+func (cfg *config) sortRows(columns []string, results [][]string) [][]string {
+	if cfg.sortBy == "" {
+		return results
+	}
+	column := columnIndex(columns, cfg.sortBy)
+	if column < 0 {
+		return results
+	}
+
+	value := func(line []string) string {
+		if column < len(line) {
+			return line[column]
+		}
+		return ""
+	}
+	less := func(a, b []string) bool {
+		return value(a) < value(b)
+	}
+	if cfg.sortBy == "size" {
+		less = func(a, b []string) bool {
+			sizeA, errA := strconv.ParseInt(value(a), 10, 64)
+			sizeB, errB := strconv.ParseInt(value(b), 10, 64)
+			if errA != nil || errB != nil {
+				return errA != nil && errB == nil
+			}
+			return sizeA < sizeB
+		}
+	}
+
+	sorted := append([][]string(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if cfg.descending {
+			return less(sorted[j], sorted[i])
+		}
+		return less(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+// limitRows returns the page of results the offset and limit flags select: at most limit of
+// them, after skipping the first offset
+func (cfg *config) limitRows(results [][]string) [][]string {
+	if cfg.offset >= len(results) {
+		return nil
+	}
+	results = results[cfg.offset:]
+
+	limit := cfg.limit
+	if limit == 0 && cfg.fuzzy {
+		limit = defaultFuzzyLimit
+	}
+	if limit > 0 && len(results) > limit {
+		return results[:limit]
+	}
+	return results
+}
+
+// matchRow reports whether the given column of line matches, or any column if column is -1
+func matchRow(line []string, column int, match func(string) bool) bool {
+	if column < 0 {
+		for _, value := range line {
+			if match(value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Make sure the line has the column. Ran into "slice bounds out of range" error without this check
+	return column < len(line) && match(line[column])
+}
+
+// sizeUnits are the suffixes understood by parseSize, longest first so "MB" isn't read as "B"
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a human-friendly size like "500KB" or "1.5GB" into bytes using base-1024
+// units. The suffix is case-insensitive and a number without one is a count of bytes.
+func parseSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	// ParseFloat also accepts NaN and infinities, which aren't sizes, and a size too big for
+	// an int64 would wrap around when converted
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(size) || math.IsInf(size, 0) || size < 0 || size*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * multiplier), nil
+}
+
+// sizeOperators are the comparison operators a size query can start with, with the two
+// character ones first so >= isn't read as > followed by a size starting with =
+var sizeOperators = []struct {
+	operator string
+	compare  func(size, threshold int64) bool
+}{
+	{">=", func(size, threshold int64) bool { return size >= threshold }},
+	{"<=", func(size, threshold int64) bool { return size <= threshold }},
+	{">", func(size, threshold int64) bool { return size > threshold }},
+	{"<", func(size, threshold int64) bool { return size < threshold }},
+	{"=", func(size, threshold int64) bool { return size == threshold }},
+}
+
+// parseSizeComparison parses a size query like >1MB, size<=500KB or =0, returning a function
+// reporting whether a Size value satisfies it. It reports false if query isn't a comparison.
+func parseSizeComparison(query string) (func(string) bool, bool) {
+	query = strings.TrimSpace(query)
+	if len(query) >= len("size") && strings.EqualFold(query[:len("size")], "size") {
+		query = strings.TrimSpace(query[len("size"):])
+	}
+	for _, op := range sizeOperators {
+		if !strings.HasPrefix(query, op.operator) {
+			continue
+		}
+		threshold, err := parseSize(strings.TrimPrefix(query, op.operator))
+		if err != nil {
+			return nil, false
+		}
+		compare := op.compare
+		return func(value string) bool {
+			size, err := strconv.ParseInt(value, 10, 64)
+			return err == nil && compare(size, threshold)
+		}, true
+	}
+	return nil, false
+}
+
+// humanizeSize formats a count of bytes using the largest base-1024 unit it fills, with one
+// decimal place dropped when it's zero, e.g. 1023B, 1KB or 1.2MB
+func humanizeSize(size int64) string {
+	for i, unit := range sizeUnits {
+		if float64(size) >= unit.multiplier && unit.multiplier > 1 {
+			// Rounding to one decimal place can carry into the next unit, like 1048575 bytes
+			// being 1024.0KB, in which case it's printed in that unit instead, as 1MB
+			if math.Round(float64(size)/unit.multiplier*10)/10 >= 1024 && i > 0 {
+				unit = sizeUnits[i-1]
+			}
+			value := strconv.FormatFloat(float64(size)/unit.multiplier, 'f', 1, 64)
+			return strings.TrimSuffix(value, ".0") + unit.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+// humanizeRows returns a copy of results with the Size column, at position sizeColumn,
+// formatted by humanizeSize. Values that aren't a valid size are left as they are.
+func humanizeRows(results [][]string, sizeColumn int) [][]string {
+	if sizeColumn < 0 {
+		return results
+	}
+
+	humanized := make([][]string, 0, len(results))
+	for _, line := range results {
+		if sizeColumn < len(line) {
+			if size, err := strconv.ParseInt(line[sizeColumn], 10, 64); err == nil {
+				line = append([]string(nil), line...)
+				line[sizeColumn] = humanizeSize(size)
+			}
+		}
+		humanized = append(humanized, line)
+	}
+	return humanized
+}
+
+// stripPathPrefix returns a copy of results with prefix removed from the start of the Path
+// column, at position pathColumn. Paths that don't start with prefix are left as they are.
+func stripPathPrefix(results [][]string, pathColumn int, prefix string) [][]string {
+	if pathColumn < 0 {
+		return results
+	}
+
+	stripped := make([][]string, 0, len(results))
+	for _, line := range results {
+		if pathColumn < len(line) && strings.HasPrefix(line[pathColumn], prefix) {
+			line = append([]string(nil), line...)
+			line[pathColumn] = strings.TrimPrefix(line[pathColumn], prefix)
+		}
+		stripped = append(stripped, line)
+	}
+	return stripped
+}
+
+// sizeInRange reports whether size is within the min-size and max-size limits
+func (cfg *config) sizeInRange(size int64) bool {
+	return (cfg.minSize < 0 || size >= cfg.minSize) && (cfg.maxSize < 0 || size <= cfg.maxSize)
+}
+
+// parseTimeLimit parses a modification time limit, either a duration like "24h" meaning that
+// long before now, or an absolute time in RFC3339 format
+func parseTimeLimit(value string, now time.Time) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	limit, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return limit, nil
+}
+
+// timeInRange reports whether modTime is within the newer-than and older-than limits
+func (cfg *config) timeInRange(modTime time.Time) bool {
+	return (cfg.newerThan.IsZero() || modTime.After(cfg.newerThan)) && (cfg.olderThan.IsZero() || modTime.Before(cfg.olderThan))
+}
+
+// rowInSizeRange reports whether the Size column of line, at position sizeColumn, is within the
+// size limits. Rows without a valid size only pass when no limits are set.
+func (cfg *config) rowInSizeRange(line []string, sizeColumn int) bool {
+	if cfg.minSize < 0 && cfg.maxSize < 0 {
+		return true
+	}
+
+	if sizeColumn < 0 || sizeColumn >= len(line) {
+		return false
+	}
+	size, err := strconv.ParseInt(line[sizeColumn], 10, 64)
+	return err == nil && cfg.sizeInRange(size)
+}
+
+// maxLineSize is the longest line content search will read before giving up on a file
+const maxLineSize = 1024 * 1024
+
+// searchContents prints the path of every indexed file with a line that matches, or only
+// how many there are if the count flag is set, and returns the number of matching files. Files
+// are searched by as many workers as the workers flag sets, which also caps how many are open
+// at once, and matches are printed as soon as every file before them has been searched, so
+// they're always in index order.
+func searchContents(cfg *config, columns []string, lines [][]string, match func(string) bool) int {
+	type contentResult struct {
+		row   int
+		path  string
+		found bool
+	}
+	rows := make(chan int)
+	results := make(chan contentResult)
+
+	// Start the workers, closing the results channel once every row has been searched
+	workers := cfg.workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range rows {
+				path, found := rowContains(cfg, columns, lines[row], match)
+				results <- contentResult{row: row, path: path, found: found}
+			}
+		}()
+	}
+	go func() {
+		for row := range lines {
+			rows <- row
+		}
+		close(rows)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Hold on to results that arrive before those of earlier rows, printing each run of
+	// results once the row before it is done
+	matches := 0
+	next := 0
+	pending := make(map[int]contentResult)
+	for result := range results {
+		pending[result.row] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if result.found {
+				matches++
+				if !cfg.countOnly {
+					fmt.Println(cfg.labeled(strings.TrimPrefix(result.path, cfg.stripPrefix)))
+				}
+			}
+		}
+	}
+
+	if cfg.countOnly {
+		fmt.Println(cfg.labeled(strconv.Itoa(matches)))
+	}
+	return matches
+}
+
+// rowContains searches the file of an index row, which has the given columns, and returns its
+// path and whether any of its lines match. Rows without a type and path, files outside the size
+// limits and files the content flags leave out aren't searched and are reported as not matching.
+func rowContains(cfg *config, columns []string, line []string, match func(string) bool) (string, bool) {
+	typeColumn, pathColumn := columnIndex(columns, "type"), columnIndex(columns, "path")
+	sizeColumn := columnIndex(columns, "size")
+
+	// Make sure the line has the Type and Path columns
+	if typeColumn < 0 || pathColumn < 0 || len(line) <= typeColumn || len(line) <= pathColumn {
+		return "", false
+	}
+	contentType, path := line[typeColumn], line[pathColumn]
+
+	// Paths stored relative to another directory are found under the base flag's directory
+	if cfg.base != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.base, path)
+	}
+
+	// Leave out files outside the size limits without opening them
+	if !cfg.rowInSizeRange(line, sizeColumn) {
+		return path, false
+	}
+
+	// Only text files are searched unless the content-all flag is set
+	if !cfg.contentAll && !strings.HasPrefix(contentType, "text/") {
+		log.Debugw("Skipping non-text file during content search",
+			"file", path,
+			"type", contentType,
+		)
+		return path, false
+	}
+
+	found, err := fileContains(path, match, !cfg.contentAll)
+	if err == errBinaryFile {
+		log.Debugw("Skipping binary file during content search", "file", path)
+		return path, false
+	}
+	if err != nil {
+		log.Warnw("Error encountered while searching file contents",
+			"file", path,
+			"error", err,
+		)
+		return path, false
+	}
+	return path, found
+}
+
+// errBinaryFile is returned by fileContains for a file that looks binary when binary files are skipped
+var errBinaryFile = errors.New("file looks binary")
+
+// fileContains reports whether any line of the file at path matches. The file is
+// streamed line by line so large files are never loaded into memory whole. If skipBinary
+// is set, a file whose start looks binary isn't searched and errBinaryFile is returned.
+func fileContains(path string, match func(string) bool, skipBinary bool) (bool, error) {
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Peek at the start of the file without consuming it, so the scanner still reads it all
+	reader := bufio.NewReader(file)
+	if skipBinary {
+		start, err := reader.Peek(512)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if looksBinary(start) {
+			return false, errBinaryFile
+		}
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if match(scanner.Text()) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// looksBinary reports whether data, the start of a file, looks like binary rather than text.
+// Like grep, a NUL byte anywhere in it is taken to mean the file isn't text.
+func looksBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// matchName reports whether name matches query in the given match mode: contains it, starts
+// with it, ends with it or equals it, optionally ignoring case
+func matchName(name, query, mode string, ignoreCase bool) bool {
+	if ignoreCase {
+		name = strings.ToLower(name)
+		query = strings.ToLower(query)
+	}
+	switch mode {
+	case "prefix":
+		return strings.HasPrefix(name, query)
+	case "suffix":
+		return strings.HasSuffix(name, query)
+	case "exact":
+		return name == query
+	default:
+		return strings.Contains(name, query)
+	}
+}
+
+// defaultFuzzyLimit is how many of the closest matches fuzzy search prints without a limit flag,
+// since every row is ranked and would otherwise be printed
+const defaultFuzzyLimit = 10
+
+// rankFuzzy returns the rows in lines, sorted by how closely the Name column, at position
+// nameColumn, matches query. Names are compared ignoring case, and both with and without
+// their extension, so "reprot" ranks "report.pdf" first. Rows that are equally close keep
+// their order in the index. The query and names are passed through normalize before comparing.
+func rankFuzzy(lines [][]string, nameColumn int, query string, normalize func(string) string) [][]string {
+	if nameColumn < 0 {
+		return nil
+	}
+
+	type ranked struct {
+		line     []string
+		distance int
+	}
+	query = strings.ToLower(normalize(query))
+	rows := make([]ranked, 0, len(lines))
+	for _, line := range lines {
+		if nameColumn >= len(line) {
+			continue
+		}
+		name := strings.ToLower(normalize(line[nameColumn]))
+		distance := levenshtein(query, name)
+		if stem := strings.TrimSuffix(name, filepath.Ext(name)); stem != name {
+			if stemDistance := levenshtein(query, stem); stemDistance < distance {
+				distance = stemDistance
+			}
+		}
+		rows = append(rows, ranked{line, distance})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].distance < rows[j].distance
+	})
+
+	results := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, row.line)
+	}
+	return results
+}
+
+// levenshtein returns the number of single character insertions, deletions and substitutions
+// needed to turn a into b
+func levenshtein(a, b string) int {
+	source, target := []rune(a), []rune(b)
+
+	// Only the previous row of the distance table is needed to fill in the next one
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
+
+// header names every column an index can have, in the order they're written. The Name, Size,
+// Type and Path columns are always written; the optional columns after them are only written
+// when the flag that fills them is set, so older four-column indexes still read the same.
+var header = []string{"Name", "Size", "Type", "Path", "Hash", "ModTime", "Mode", "UID", "GID", "Charset", "RelPath"}
+
+// recordModTime reports whether the flags that are set need each file's modification time
+func (cfg *config) recordModTime() bool {
+	return cfg.mtime || cfg.update || cfg.recent > 0
+}
+
+// indexColumns returns the columns to write to a new index given the flags that are set
+func (cfg *config) indexColumns() []string {
+	columns := append([]string(nil), header[:columnIndex(header, "hash")]...)
+	if cfg.hashFiles {
+		columns = append(columns, "Hash")
+	}
+	if cfg.recordModTime() {
+		columns = append(columns, "ModTime")
+	}
+	if cfg.perms {
+		columns = append(columns, "Mode", "UID", "GID")
+	}
+	if cfg.splitCharset {
+		columns = append(columns, "Charset")
+	}
+	if cfg.relPath {
+		columns = append(columns, "RelPath")
+	}
+	return columns
+}
+
+// columnIndex returns the position of the column named field in columns, or -1 if there is
+// no such column. Looking columns up by name keeps search in sync with each index's header.
+func columnIndex(columns []string, field string) int {
+	for i, name := range columns {
+		if strings.EqualFold(name, field) {
+			return i
+		}
+	}
+	return -1
+}
+
+// value returns the file detail stored in the named column
+func (f FileInfo) value(column string) string {
+	switch strings.ToLower(column) {
+	case "name":
+		return f.Name
+	case "size":
+		return strconv.FormatInt(f.Size, 10)
+	case "type":
+		return f.Type
+	case "path":
+		return f.Path
+	case "hash":
+		return f.Hash
+	case "modtime":
+		return f.ModTime
+	case "mode":
+		return f.Mode
+	case "uid":
+		return f.UID
+	case "gid":
+		return f.GID
+	case "charset":
+		return f.Charset
+	case "relpath":
+		return f.RelPath
+	}
+	return ""
+}
+
+// record returns the file details as a row with one value per column
+func (f FileInfo) record(columns []string) []string {
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = f.value(column)
+	}
+	return record
+}
+
+// fileInfoFromRecord is the inverse of record, building the file details from a row of an
+// index with the given columns. Missing columns are left empty and a size that doesn't parse
+// is left as zero.
+func fileInfoFromRecord(columns []string, record []string) FileInfo {
+	value := func(field string) string {
+		if column := columnIndex(columns, field); column >= 0 && column < len(record) {
+			return record[column]
+		}
+		return ""
+	}
+
+	size, _ := strconv.ParseInt(value("size"), 10, 64)
+	return FileInfo{
+		Name:    value("name"),
+		Size:    size,
+		Type:    value("type"),
+		Path:    value("path"),
+		Hash:    value("hash"),
+		ModTime: value("modtime"),
+		Mode:    value("mode"),
+		UID:     value("uid"),
+		GID:     value("gid"),
+		Charset: value("charset"),
+		RelPath: value("relpath"),
+	}
+}
+
+// indexWriter writes file details to an index one file at a time, so the whole index never
+// has to be held in memory. Like csv.Writer, errors are remembered and returned by Close,
+// which finishes writing the index and closes the file.
+type indexWriter interface {
+	Write(fileInfo FileInfo)
+	Close() error
+}
+
+// abortableIndexWriter is an indexWriter that can also be told to discard what it's written
+type abortableIndexWriter interface {
+	indexWriter
+	Abort()
+}
+
+// createIndexWriter returns a writer for an index at path in the given format. The columns are
+// those to write for formats with a fixed set of columns. The index is written to a temporary
+// file next to path, which only replaces path once it's complete, so an existing index is never
+// left truncated or half-written. A path of stdioPath writes the index to stdout instead. The
+// index is compressed if its path ends in .gz or compress is set. A non-nil metadata is written
+// before the files.
+func createIndexWriter(path, format string, columns []string, writeHeader bool, delimiter rune, compress bool, metadata *indexMetadata) (abortableIndexWriter, error) {
+	compress = compress || isGzipPath(path)
+
+	// Stdout is left open once the index is written, for anything printed afterwards
+	if path == stdioPath {
+		var file io.WriteCloser = nopWriteCloser{os.Stdout}
+		if compress {
+			file = &gzipFile{Writer: gzip.NewWriter(os.Stdout), file: nopWriteCloser{os.Stdout}}
+		}
+		return &stdoutIndexWriter{newStreamIndexWriter(file, format, columns, writeHeader, delimiter, metadata)}, nil
+	}
+
+	// Create the temporary file in the same directory so renaming it over path is atomic
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, &IndexWriteError{Path: path, Err: err}
+	}
+	atomic := &atomicIndexWriter{path: path, temp: temp.Name()}
+
+	// CreateTemp only lets the owner read the file, unlike a file made by os.Create
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		os.Remove(atomic.temp)
+		return nil, &IndexWriteError{Path: path, Err: err}
+	}
+
+	switch format {
+	case "sqlite":
+		// SQLite opens the file itself, treating the empty file as an empty database
+		temp.Close()
+		atomic.indexWriter, err = newSQLiteIndexWriter(atomic.temp)
+		if err != nil {
+			os.Remove(atomic.temp)
+			return nil, &IndexWriteError{Path: path, Err: err}
+		}
+	default:
+		var file io.WriteCloser = temp
+		if compress {
+			file = &gzipFile{Writer: gzip.NewWriter(temp), file: temp}
+		}
+		atomic.indexWriter = newStreamIndexWriter(file, format, columns, writeHeader, delimiter, metadata)
+	}
+	return atomic, nil
+}
+
+// newStreamIndexWriter returns a writer for an index in one of the formats written as a stream
+// of bytes to file, which is every format but sqlite
+func newStreamIndexWriter(file io.WriteCloser, format string, columns []string, writeHeader bool, delimiter rune, metadata *indexMetadata) indexWriter {
+	switch format {
+	case "json":
+		return &jsonIndexWriter{file: file, w: bufio.NewWriter(file), metadata: metadata}
+	case "ndjson":
+		return &ndjsonIndexWriter{file: file, w: bufio.NewWriter(file)}
+	case "yaml":
+		return &yamlIndexWriter{file: file, w: bufio.NewWriter(file)}
+	default:
+		return newCSVIndexWriter(file, columns, writeHeader, delimiter, metadata)
+	}
+}
+
+// gzipFile compresses everything written to it into file. Closing it writes the gzip trailer
+// before closing the file, so the index writers can close it like the file itself.
+type gzipFile struct {
+	*gzip.Writer
+	file io.Closer
+}
+
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
+// isGzipPath reports whether the index at path is gzip-compressed, going by its extension
+func isGzipPath(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gz")
+}
+
+// inferFormat returns the index format implied by the extension of path, looking past a .gz
+// extension to the one before it, or csv if the extension isn't a known one
+func inferFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(trimGzipExt(path))) {
+	case ".json":
+		return "json"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".sqlite", ".sqlite3", ".db":
+		return "sqlite"
+	default:
+		return "csv"
+	}
+}
+
+// trimGzipExt returns path without a .gz extension, so the extension before it can be checked
+func trimGzipExt(path string) string {
+	if isGzipPath(path) {
+		return path[:len(path)-len(filepath.Ext(path))]
+	}
+	return path
+}
+
+// atomicIndexWriter writes an index to a temporary file and renames it to the index path when
+// closed, or removes it when aborted
+type atomicIndexWriter struct {
+	indexWriter
+	path string
+	temp string
+}
+
+// Close finishes writing the index and moves it into place. If writing failed, the temporary
+// file is removed and the existing index is left as it was.
+func (a *atomicIndexWriter) Close() error {
+	if err := a.indexWriter.Close(); err != nil {
+		os.Remove(a.temp)
+		return &IndexWriteError{Path: a.path, Err: err}
+	}
+	if err := os.Rename(a.temp, a.path); err != nil {
+		os.Remove(a.temp)
+		return &IndexWriteError{Path: a.path, Err: err}
+	}
+	return nil
+}
+
+// Abort discards the index written so far, leaving the existing index as it was
+func (a *atomicIndexWriter) Abort() {
+	a.indexWriter.Close()
+	os.Remove(a.temp)
+}
+
+// stdoutIndexWriter writes an index to stdout as it's built
+type stdoutIndexWriter struct {
+	indexWriter
+}
+
+// Close finishes writing the index, flushing anything still buffered
+func (s *stdoutIndexWriter) Close() error {
+	if err := s.indexWriter.Close(); err != nil {
+		return &IndexWriteError{Path: stdioPath, Err: err}
+	}
+	return nil
+}
+
+// Abort stops writing the index. Whatever's already been written to stdout can't be taken back,
+// so it's flushed rather than left half in the buffer.
+func (s *stdoutIndexWriter) Abort() {
+	s.indexWriter.Close()
+}
+
+// nopWriteCloser is a writer whose Close does nothing, to write an index to stdout without
+// closing it
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// indexMetadata records where, when and how an index was built, for the metadata flag
+type indexMetadata struct {
+	Root        string   `json:"root"`
+	GeneratedAt string   `json:"generated_at"`
+	ToolVersion string   `json:"tool_version"`
+	Flags       []string `json:"flags"`
+}
+
+// indexMetadata returns the metadata to write at the top of the index, or nil if the metadata
+// flag isn't set
+func (cfg *config) indexMetadata() *indexMetadata {
+	if !cfg.metadata {
+		return nil
+	}
+	return &indexMetadata{
+		Root:        cfg.directories.String(),
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		ToolVersion: version,
+		Flags:       cfg.flagsUsed,
+	}
+}
+
+// csvCommentPrefix starts the metadata lines at the top of a CSV index. It names the tool so a
+// file whose name starts with "# " isn't mistaken for metadata in an index without a header.
+const csvCommentPrefix = "# index-search "
+
+// metadataKeys are the keys of the metadata lines of a CSV index, in the order they're written
+var metadataKeys = []string{"root", "generated_at", "tool_version", "flags"}
+
+// commentLines returns the metadata as the comment lines written before the header of a CSV
+// index, one "# index-search key: value" line per field
+func (m *indexMetadata) commentLines() []string {
+	values := []string{m.Root, m.GeneratedAt, m.ToolVersion, strings.Join(m.Flags, " ")}
+	lines := make([]string, len(metadataKeys))
+	for i, key := range metadataKeys {
+		lines[i] = csvCommentPrefix + key + ": " + values[i]
+	}
+	return lines
+}
+
+// csvIndexWriter writes a header followed by one CSV row per file
+type csvIndexWriter struct {
+	file    io.Closer
+	writer  *csv.Writer
+	columns []string
+	err     error
+}
+
+func newCSVIndexWriter(file io.WriteCloser, columns []string, writeHeader bool, delimiter rune, metadata *indexMetadata) *csvIndexWriter {
+	writer := csv.NewWriter(file)
+	writer.Comma = delimiter
+
+	// Write the metadata as comment lines before the header. Nothing has been written to the
+	// buffered csv writer yet, so they go straight to the file to keep them from being quoted.
+	var err error
+	if metadata != nil {
+		for _, line := range metadata.commentLines() {
+			if _, err = io.WriteString(file, line+"\n"); err != nil {
+				break
+			}
+		}
+	}
+
+	// Write the headers to the CSV file, unless the no-header flag left them out
+	if writeHeader {
+		writer.Write(columns)
+	}
+
+	return &csvIndexWriter{file: file, writer: writer, columns: columns, err: err}
 }
 
-// log is a global logger that is faster and more useful than the standard logger
-var log *zap.SugaredLogger
-
-// CLI flags
-var verbose bool
-var index bool
-var searchQuery string
-var directory string
-
-func init() {
-	flag.BoolVar(&verbose, "v", false, "verbose output")
-	flag.BoolVar(&verbose, "verbose", false, "verbose output")
-	flag.BoolVar(&index, "i", false, "index files")
-	flag.BoolVar(&index, "index", false, "index files")
-	flag.StringVar(&searchQuery, "s", "", "search query")
-	flag.StringVar(&searchQuery, "search", "", "search query")
-	flag.StringVar(&directory, "d", "", "relative path to the directory to search")
-	flag.StringVar(&directory, "directory", "", "relative path to the directory to search")
-	flag.Parse()
-
-	// If verbose flag is set, create a logger with debug level.
-	// Otherwise, create a logger with info level.
-	var logger *zap.Logger
-	var err error
+func (c *csvIndexWriter) Write(fileInfo FileInfo) {
+	c.writer.Write(fileInfo.record(c.columns))
+}
 
-	if verbose {
-		cfg := zap.NewDevelopmentConfig()
-		cfg.Level.SetLevel(zap.DebugLevel)
-		logger, err = cfg.Build()
-		if err != nil {
-			panic(err)
+func (c *csvIndexWriter) Close() error {
+	if c.err != nil {
+		c.file.Close()
+		return c.err
+	}
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+// jsonIndexWriter writes an indented JSON array with one object per file, laid out the same
+// as encoding the whole slice with json.Encoder and an indent of two spaces. With metadata,
+// the array is the files field of an object holding the metadata, laid out the same way.
+type jsonIndexWriter struct {
+	file     io.Closer
+	w        *bufio.Writer
+	metadata *indexMetadata
+	count    int
+	err      error
+}
+
+// indent returns the indent of the files in the array, which is one level deeper when the
+// array is inside the metadata object
+func (j *jsonIndexWriter) indent() string {
+	if j.metadata != nil {
+		return "    "
+	}
+	return "  "
+}
+
+// open writes the start of the index before the files, which is the metadata object up to
+// its files field when there's metadata and nothing otherwise
+func (j *jsonIndexWriter) open() error {
+	if j.metadata == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(j.metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = j.w.WriteString(strings.TrimSuffix(string(data), "\n}") + ",\n  \"files\": ")
+	return err
+}
+
+func (j *jsonIndexWriter) Write(fileInfo FileInfo) {
+	if j.err != nil {
+		return
+	}
+
+	data, err := json.MarshalIndent(fileInfo, j.indent(), "  ")
+	if err != nil {
+		j.err = err
+		return
+	}
+
+	// Open the array before the first file and separate the rest from the one before
+	separator := ",\n" + j.indent()
+	if j.count == 0 {
+		if j.err = j.open(); j.err != nil {
+			return
 		}
-	} else {
-		cfg := zap.NewProductionConfig()
-		cfg.Level.SetLevel(zap.InfoLevel)
-		logger, err = cfg.Build()
-		if err != nil {
-			panic(err)
+		separator = "[\n" + j.indent()
+	}
+	j.count++
+
+	if _, err := j.w.WriteString(separator); err != nil {
+		j.err = err
+		return
+	}
+	_, j.err = j.w.Write(data)
+}
+
+func (j *jsonIndexWriter) Close() error {
+	if j.err != nil {
+		j.file.Close()
+		return j.err
+	}
+
+	// Close the array, which is empty if no files were written, and the metadata object
+	end := "\n]\n"
+	if j.metadata != nil {
+		end = "\n  ]\n}\n"
+	}
+	if j.count == 0 {
+		if err := j.open(); err != nil {
+			j.file.Close()
+			return err
+		}
+		end = "[]\n"
+		if j.metadata != nil {
+			end = "[]\n}\n"
 		}
 	}
+	if _, err := j.w.WriteString(end); err != nil {
+		j.file.Close()
+		return err
+	}
+	if err := j.w.Flush(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
 
-	log = logger.Sugar()
+// ndjsonIndexWriter writes one compact JSON object per file per line, so the index can be read
+// a line at a time without loading a whole array
+type ndjsonIndexWriter struct {
+	file io.Closer
+	w    *bufio.Writer
+	err  error
 }
 
-func main() {
+func (n *ndjsonIndexWriter) Write(fileInfo FileInfo) {
+	if n.err != nil {
+		return
+	}
 
-	// If the directory flag is not provided but the index flag is, return an error
-	if directory == "" && index {
-		log.Fatalw("No directory flag provided. Please provide a relative path to the directory to index with the directory flag.")
+	data, err := json.Marshal(fileInfo)
+	if err != nil {
+		n.err = err
+		return
 	}
+	if _, err := n.w.Write(data); err != nil {
+		n.err = err
+		return
+	}
+	n.err = n.w.WriteByte('\n')
+}
 
-	// If both searchQuery and index are false, return an error
-	if searchQuery == "" && !index {
-		log.Fatalw("No search query or index flag provided. Please provide a search query and/or the index flag.")
+func (n *ndjsonIndexWriter) Close() error {
+	if n.err != nil {
+		n.file.Close()
+		return n.err
 	}
+	if err := n.w.Flush(); err != nil {
+		n.file.Close()
+		return err
+	}
+	return n.file.Close()
+}
 
-	// If search query is provided and index is not, run the search and exit
-	if searchQuery != "" && !index {
-		search(searchQuery)
+// yamlIndexWriter writes a YAML sequence with one mapping per file, laid out the same as
+// encoding the whole slice with yaml.Marshal but a file at a time
+type yamlIndexWriter struct {
+	file  io.Closer
+	w     *bufio.Writer
+	count int
+	err   error
+}
+
+func (y *yamlIndexWriter) Write(fileInfo FileInfo) {
+	if y.err != nil {
 		return
 	}
 
-	// Otherwise, index the files and exit
+	// Each file is marshaled as a sequence of one, which is its own item of the whole sequence
+	data, err := yaml.Marshal([]FileInfo{fileInfo})
+	if err != nil {
+		y.err = err
+		return
+	}
+	y.count++
+	_, y.err = y.w.Write(data)
+}
 
-	// Create a slice to hold all the file information
-	var files []FileInfo
+func (y *yamlIndexWriter) Close() error {
+	if y.err != nil {
+		y.file.Close()
+		return y.err
+	}
 
-	// Walk through the specified directory recursively
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Errorw("Error encountered while walking through files. Are you sure the directory exists and is correct?",
-				"error", err,
-			)
+	// A sequence with no items has to be written as an empty flow sequence
+	if y.count == 0 {
+		if _, err := y.w.WriteString("[]\n"); err != nil {
+			y.file.Close()
 			return err
 		}
+	}
+	if err := y.w.Flush(); err != nil {
+		y.file.Close()
+		return err
+	}
+	return y.file.Close()
+}
+
+// sqliteSchema creates the files table of a SQLite index, with an index on name so name
+// searches don't have to scan every row
+const sqliteSchema = `
+CREATE TABLE files (
+	name TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	path TEXT NOT NULL,
+	hash TEXT NOT NULL DEFAULT '',
+	mod_time TEXT NOT NULL DEFAULT '',
+	mode TEXT NOT NULL DEFAULT '',
+	uid TEXT NOT NULL DEFAULT '',
+	gid TEXT NOT NULL DEFAULT '',
+	charset TEXT NOT NULL DEFAULT '',
+	rel_path TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX files_name ON files (name);
+`
+
+// sqliteIndexWriter inserts one row per file into the files table of a SQLite database, all
+// in a single transaction that's committed by Close
+type sqliteIndexWriter struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+	err    error
+}
+
+func newSQLiteIndexWriter(path string) (*sqliteIndexWriter, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	insert, err := tx.Prepare("INSERT INTO files (name, size, type, path, hash, mod_time, mode, uid, gid, charset, rel_path) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteIndexWriter{db: db, tx: tx, insert: insert}, nil
+}
+
+func (s *sqliteIndexWriter) Write(fileInfo FileInfo) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = s.insert.Exec(fileInfo.Name, fileInfo.Size, fileInfo.Type, fileInfo.Path, fileInfo.Hash, fileInfo.ModTime, fileInfo.Mode, fileInfo.UID, fileInfo.GID, fileInfo.Charset, fileInfo.RelPath)
+}
+
+func (s *sqliteIndexWriter) Close() error {
+	defer s.db.Close()
+	s.insert.Close()
+
+	if s.err != nil {
+		s.tx.Rollback()
+		return s.err
+	}
+	return s.tx.Commit()
+}
 
-		// Exclude any ".git" directory
-		if strings.HasPrefix(info.Name(), ".git") {
-			if info.IsDir() {
-				return filepath.SkipDir // Skip the directory and all its subdirectories
-			} else {
-				return nil // Skip the file
+// stdioPath is the output path that makes indexing write the index to stdout, and search read
+// it from stdin
+const stdioPath = "-"
+
+// loadIndex reads the existing index named by the output flag, failing with exitIndexRead if it
+// can't be read
+func loadIndex(cfg *config) ([]string, [][]string, error) {
+	columns, lines, err := readIndex(cfg.output, cfg.format, cfg.delimiter)
+	if err != nil {
+		return nil, nil, indexReadError(cfg, err)
+	}
+	return columns, lines, nil
+}
+
+// indexReadError returns the exitIndexRead failure for err from reading the existing index,
+// suggesting the index flag if the index doesn't exist yet
+func indexReadError(cfg *config, err error) error {
+	if os.IsNotExist(err) {
+		return fail(exitIndexRead, "Failed to open index file or the file does not exist. Be sure to run the program with the -i flag to create an index file", "filename", cfg.output, "error", err)
+	}
+	return fail(exitIndexRead, "Failed to read index file", "filename", cfg.output, "error", err)
+}
+
+// readIndex reads the index file at path in the given format, returning its columns and
+// one row per file. A path of stdioPath reads the index from stdin instead.
+func readIndex(path, format string, delimiter rune) ([]string, [][]string, error) {
+	if format == "sqlite" {
+		return readSQLiteIndex(path, "", nil)
+	}
+
+	// Decompress the index if its path ends in .gz. Stdin has no extension, so it's checked
+	// for the gzip magic number instead.
+	var file io.Reader
+	if path == stdioPath {
+		buffered := bufio.NewReader(os.Stdin)
+		file = buffered
+		if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			decompressed, err := gzip.NewReader(buffered)
+			if err != nil {
+				return nil, nil, err
 			}
+			defer decompressed.Close()
+			file = decompressed
+		}
+	} else {
+		opened, err := openIndexFile(path)
+		if err != nil {
+			return nil, nil, err
 		}
+		defer opened.Close()
+		file = opened
+	}
 
-		// If it's not a directory, it's a file
-		if !info.IsDir() {
-			// Open the file
-			file, err := os.Open(path)
-			if err != nil {
-				log.Errorw("Error encountered while opening file",
-					"file", path,
-					"error", err,
-				)
-				return err
+	switch format {
+	case "json":
+		return readJSONIndex(file)
+	case "ndjson":
+		return readNDJSONIndex(file)
+	case "yaml":
+		return readYAMLIndex(file)
+	}
+	return readCSVIndex(file, delimiter)
+}
+
+// openIndexFile opens the index file at path for reading, decompressing it if its path ends
+// in .gz
+func openIndexFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isGzipPath(path) {
+		return file, nil
+	}
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: decompressed, file: file}, nil
+}
+
+// gzipReadCloser decompresses the contents of file. Closing it closes both the gzip reader and
+// the file, like gzipFile does when writing.
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	if err := g.Reader.Close(); err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
+// indexLayout is how an existing index file was written, beyond its columns and rows: the
+// delimiter and header of a CSV index, and the metadata at the top of a csv or json index
+type indexLayout struct {
+	delimiter rune
+	header    bool
+	metadata  *indexMetadata
+}
+
+// readIndexLayout reads how the index file at path in the given format was written, so it can
+// be rewritten the same way. An index without a delimiter of its own, or an empty one, is
+// taken to use delimiter and have a header, like a new index.
+func readIndexLayout(path, format string, delimiter rune) (indexLayout, error) {
+	layout := indexLayout{delimiter: delimiter, header: true}
+	if format != "csv" && format != "json" {
+		return layout, nil
+	}
+
+	file, err := openIndexFile(path)
+	if err != nil {
+		return layout, err
+	}
+	defer file.Close()
+
+	// A json index with metadata is an object holding it, rather than an array of files
+	if format == "json" {
+		var data json.RawMessage
+		if err := json.NewDecoder(file).Decode(&data); err != nil && err != io.EOF {
+			return layout, err
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			layout.metadata = &indexMetadata{}
+			if err := json.Unmarshal(data, layout.metadata); err != nil {
+				return layout, err
 			}
-			defer file.Close()
+		}
+		return layout, nil
+	}
+
+	// A CSV index has its metadata lines before anything else, then the header if it has one,
+	// whose first cell is followed by the delimiter
+	buffered := bufio.NewReader(file)
+	lines, err := skipMetadata(buffered)
+	if err != nil {
+		return layout, err
+	}
+	layout.metadata = parseCommentLines(lines)
+	layout.delimiter = detectDelimiter(buffered, delimiter)
+	reader := csv.NewReader(buffered)
+	reader.Comma = layout.delimiter
+	reader.FieldsPerRecord = -1
+	if record, err := reader.Read(); err == nil {
+		layout.header = isHeader(record)
+	}
+	return layout, nil
+}
 
-			// Create a buffer to read the content of the file
-			buffer := make([]byte, 512)
+// csvDelimiters maps the values the delimiter flag takes to the delimiters they stand for
+var csvDelimiters = map[string]rune{
+	",":   ',',
+	"\t":  '\t',
+	`\t`:  '\t',
+	"tab": '\t',
+	";":   ';',
+	"|":   '|',
+}
 
-			// Read from the file to the buffer
-			_, err = file.Read(buffer)
-			if err != nil {
-				log.Errorw("Error encountered while reading file",
-					"file", path,
-					"error", err,
-				)
-				return err
+// skipMetadata reads past the metadata comment lines at the start of the CSV index read by r,
+// if it has any, leaving r at the header or first file. Only lines starting with the prefix and
+// one of the keys commentLines writes are metadata. The lines are returned without their line
+// endings.
+func skipMetadata(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		if !metadataLineAhead(r) {
+			return lines, nil
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if err == io.EOF {
+			return lines, nil
+		}
+	}
+}
+
+// metadataLineAhead reports whether the next line read by r is a metadata comment line, without
+// reading it
+func metadataLineAhead(r *bufio.Reader) bool {
+	for _, key := range metadataKeys {
+		marker := csvCommentPrefix + key + ": "
+		if head, _ := r.Peek(len(marker)); string(head) == marker {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCommentLines is the inverse of commentLines, returning the metadata held by the comment
+// lines of a CSV index, or nil if there are none
+func parseCommentLines(lines []string) *indexMetadata {
+	if len(lines) == 0 {
+		return nil
+	}
+	metadata := &indexMetadata{}
+	for _, line := range lines {
+		key, value, _ := strings.Cut(strings.TrimPrefix(line, csvCommentPrefix), ": ")
+		switch key {
+		case "root":
+			metadata.Root = value
+		case "generated_at":
+			metadata.GeneratedAt = value
+		case "tool_version":
+			metadata.ToolVersion = value
+		case "flags":
+			metadata.Flags = strings.Fields(value)
+		}
+	}
+	return metadata
+}
+
+// detectDelimiter returns the delimiter of the CSV index read by r, going by the character
+// after the Name cell its header starts with. An index without a header uses delimiter.
+func detectDelimiter(r *bufio.Reader, delimiter rune) rune {
+	head, _ := r.Peek(len("Name") + 1)
+	if len(head) == len("Name")+1 && string(head[:len("Name")]) == "Name" {
+		for _, candidate := range csvDelimiters {
+			if rune(head[len("Name")]) == candidate {
+				return candidate
 			}
+		}
+	}
+	return delimiter
+}
+
+// readCSVIndex reads a CSV index from r, returning the columns named by its header and the
+// rows after it. The delimiter is detected from the header, falling back to delimiter.
+func readCSVIndex(r io.Reader, delimiter rune) ([]string, [][]string, error) {
+	// Rows are checked against the columns below rather than by the reader, so a single
+	// malformed row is skipped instead of failing the whole index
+	buffered := bufio.NewReader(r)
+	if _, err := skipMetadata(buffered); err != nil {
+		return nil, nil, err
+	}
+	reader := csv.NewReader(buffered)
+	reader.Comma = detectDelimiter(buffered, delimiter)
+	reader.FieldsPerRecord = -1
 
-			// Attempt to detect the content type of the file
-			contentType := http.DetectContentType(buffer)
+	var columns []string
+	var lines [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			log.Warnw("Skipping malformed row in index file", "line", parseErr.Line, "error", err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 
-			// Append the file details to the slice
-			files = append(files, FileInfo{
-				Name: info.Name(),
-				Size: info.Size(),
-				Type: contentType,
-				Path: path,
-			})
+		// The first line is normally the header, naming the columns of the rows after it. An
+		// index written with the no-header flag starts with a file instead, so its columns are
+		// worked out from the first row rather than dropping that file.
+		if columns == nil {
+			if isHeader(record) {
+				columns = record
+				continue
+			}
+			columns = headerlessColumns(record)
+		}
 
-			// Log the file details
-			log.Debugw("Successfully indexed file",
-				"file", path,
-				"name", info.Name(),
-				"size", info.Size(),
-				"type", contentType,
+		// Every row must have a value for each column, or its values can't be told apart
+		if len(record) != len(columns) {
+			line, _ := reader.FieldPos(0)
+			log.Warnw("Skipping row in index file with the wrong number of columns",
+				"line", line,
+				"columns", len(record),
+				"expected", len(columns),
 			)
+			continue
 		}
-		return nil
-	})
+		lines = append(lines, record)
+	}
+	return columns, lines, nil
+}
 
-	// If an error occurred during the walk, log it
-	if err != nil {
-		log.Fatalw("Error encountered while walking through files",
-			"error", err,
-		)
+// isHeader reports whether row is a header rather than a file. It's a header if its first
+// cell is literally "Name" and every cell names a column an index can have, so a file that
+// happens to be called Name, whose next cell is a size, is still read as a file.
+func isHeader(row []string) bool {
+	if len(row) == 0 || row[0] != "Name" {
+		return false
+	}
+	for _, cell := range row {
+		if columnIndex(header, cell) < 0 {
+			return false
+		}
 	}
+	return true
+}
 
-	// Create a new CSV file called "index.csv"
-	file, err := os.Create("./index.csv")
-	if err != nil {
-		log.Fatalw("Error encountered while creating index.csv",
-			"error", err,
-		)
+// headerlessColumns returns the columns of a CSV index without a header, going by the cells in
+// its first row. The optional columns are written in header order, so a trailing Mode, UID and
+// GID are recognized by the octal mode, and a single column before them is ModTime if it holds
+// a time and Hash otherwise.
+func headerlessColumns(row []string) []string {
+	columns := append([]string(nil), header[:columnIndex(header, "hash")]...)
+	if len(row) < len(columns) {
+		return columns
 	}
-	defer file.Close()
+	optional := row[len(columns):]
 
-	// Create a CSV writer
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	perms := len(optional) >= 3 && octalMode.MatchString(optional[len(optional)-3])
+	if perms {
+		optional = optional[:len(optional)-3]
+	}
+
+	switch len(optional) {
+	case 1:
+		if _, err := time.Parse(time.RFC3339, optional[0]); err == nil {
+			columns = append(columns, "ModTime")
+		} else {
+			columns = append(columns, "Hash")
+		}
+	case 2:
+		columns = append(columns, "Hash", "ModTime")
+	}
+	if perms {
+		columns = append(columns, "Mode", "UID", "GID")
+	}
+	return columns
+}
 
-	// Write the headers to the CSV file
-	writer.Write([]string{"Name", "Size", "Type", "Path"})
+// octalMode matches a Mode column value, as written by fileMode
+var octalMode = regexp.MustCompile(`^[0-7]{4}$`)
 
-	// Write each file's details as a row in the CSV file
-	for _, fileInfo := range files {
-		writer.Write([]string{
-			fileInfo.Name,
-			strconv.FormatInt(fileInfo.Size, 10),
-			fileInfo.Type,
-			fileInfo.Path,
-		})
+// readJSONIndex reads a JSON index from r and returns its files as rows, with the same columns
+// a CSV index of the same files would have, so both formats can be searched the same way
+func readJSONIndex(r io.Reader) ([]string, [][]string, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		// An empty file has no files in it rather than being invalid
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
 	}
 
-	// Flush the data to the file
-	writer.Flush()
+	// An index written with the metadata flag is an object with the files in its files field
+	// rather than an array of them
+	var files []FileInfo
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var index struct {
+			Files []FileInfo `json:"files"`
+		}
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, nil, err
+		}
+		files = index.Files
+	} else if err := json.Unmarshal(data, &files); err != nil {
+		return nil, nil, err
+	}
 
-	// Check if any error occurred while flushing
-	if err := writer.Error(); err != nil {
-		log.Fatalw("Error encountered while writing to index.csv",
-			"error", err,
-		)
+	columns, lines := filesToRows(files)
+	return columns, lines, nil
+}
+
+// readYAMLIndex reads a YAML index from r and returns its files as rows the same way as
+// readJSONIndex. Like a json index, the whole sequence is decoded into memory at once, so an
+// ndjson or csv index is better suited to large trees.
+func readYAMLIndex(r io.Reader) ([]string, [][]string, error) {
+	var files []FileInfo
+	if err := yaml.NewDecoder(r).Decode(&files); err != nil {
+		// An empty file has no files in it rather than being invalid
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
 	}
 
-	// Log the creation of the index file
-	log.Infow("Successfully created index file",
-		"filename", "index.csv",
-		"fileCount", len(files),
-	)
+	columns, lines := filesToRows(files)
+	return columns, lines, nil
+}
 
-	// If the search query and the index flag are provided, run the search
-	if searchQuery != "" && index {
-		search(searchQuery)
-		return
+// readNDJSONIndex reads an index with one JSON object per line from r, a line at a time, and
+// returns its files as rows the same way as readJSONIndex. Blank lines are ignored, and lines
+// that aren't a valid object are skipped with a warning like malformed CSV rows.
+func readNDJSONIndex(r io.Reader) ([]string, [][]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	var files []FileInfo
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var fileInfo FileInfo
+		if err := json.Unmarshal(line, &fileInfo); err != nil {
+			log.Warnw("Skipping malformed line in index file", "line", number, "error", err)
+			continue
+		}
+		files = append(files, fileInfo)
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	columns, lines := filesToRows(files)
+	return columns, lines, nil
 }
 
-func search(query string) {
+// readSQLiteIndex reads the files in a SQLite index at path that match the where clause, with
+// its args, or every file if the clause is empty. They're returned as rows the same way as
+// readJSONIndex.
+func readSQLiteIndex(path, where string, args []interface{}) ([]string, [][]string, error) {
+	// Opening a database that doesn't exist would create it, so check for the file first
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, err
+	}
 
-	// Open the index file
-	file, err := os.Open("./index.csv")
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
-		log.Fatalw("Failed to open index file or the file does not exist. Be sure to run the program with the -i flag to create an index.csv file", "error", err)
+		return nil, nil, err
 	}
-	defer file.Close()
+	defer db.Close()
 
-	reader := csv.NewReader(file)
-	lines, err := reader.ReadAll()
+	query := "SELECT name, size, type, path, hash, mod_time, mode, uid, gid, charset, rel_path FROM files"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := db.Query(query+" ORDER BY rowid", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
 
-	// Check if the lines slice is empty
-	if len(lines) == 0 {
-		log.Warnw("Index file is empty.")
-		return
+	var files []FileInfo
+	for rows.Next() {
+		var fileInfo FileInfo
+		if err := rows.Scan(&fileInfo.Name, &fileInfo.Size, &fileInfo.Type, &fileInfo.Path, &fileInfo.Hash, &fileInfo.ModTime, &fileInfo.Mode, &fileInfo.UID, &fileInfo.GID, &fileInfo.Charset, &fileInfo.RelPath); err != nil {
+			return nil, nil, err
+		}
+		files = append(files, fileInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
 	}
 
-	if err != nil {
-		log.Fatalw("Failed to read index file", "error", err)
+	columns, lines := filesToRows(files)
+	return columns, lines, nil
+}
+
+// querySQLiteIndex reads only the files in a SQLite index at path whose name matches query in
+// the given match mode. SQLite's LIKE ignores case, so GLOB is used instead for case-sensitive
+// searches.
+func querySQLiteIndex(path, query, mode string, ignoreCase bool) ([]string, [][]string, error) {
+	// wildcards surrounds the escaped query with the operator's wildcard on the sides the match
+	// mode leaves open, so an exact match has none and a substring match has both
+	wildcards := func(escaped, wildcard string) string {
+		switch mode {
+		case "prefix":
+			return escaped + wildcard
+		case "suffix":
+			return wildcard + escaped
+		case "exact":
+			return escaped
+		default:
+			return wildcard + escaped + wildcard
+		}
+	}
+
+	// Escape the characters each operator treats as wildcards so the query matches as plain text
+	if ignoreCase {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+		return readSQLiteIndex(path, `name LIKE ? ESCAPE '\'`, []interface{}{wildcards(escaped, "%")})
 	}
+	escaped := strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]").Replace(query)
+	return readSQLiteIndex(path, "name GLOB ?", []interface{}{wildcards(escaped, "*")})
+}
+
+// isASCII reports whether s only holds ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
 
-	// The first line is the header, skip it
-	for _, line := range lines[1:] {
-		// Make sure the line has at least one column. Ran into "slice bounds out of range" error without this check
-		if len(line) > 0 {
-			// We assume that Name is in the first column
-			if strings.Contains(line[0], query) {
-				fmt.Println(line)
+// filesToRows returns files as rows, including each optional column only if some file has a
+// value for it, so they have the same columns a CSV index of the same files would have
+func filesToRows(files []FileInfo) ([]string, [][]string) {
+	columns := append([]string(nil), header[:columnIndex(header, "hash")]...)
+	for _, column := range header[len(columns):] {
+		for _, fileInfo := range files {
+			if fileInfo.value(column) != "" {
+				columns = append(columns, column)
+				break
 			}
 		}
 	}
+
+	lines := make([][]string, 0, len(files))
+	for _, fileInfo := range files {
+		lines = append(lines, fileInfo.record(columns))
+	}
+	return columns, lines
 }
@@ -0,0 +1,1301 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// treeEntry describes one entry of a tree made by makeTree. An entry is a file holding Content,
+// or Size bytes of text if Content is empty, unless Link is set, which makes it a symlink to
+// Link, or Dir is set, which makes it an empty directory.
+type treeEntry struct {
+	Content string
+	Size    int
+	Link    string
+	Dir     bool
+}
+
+// makeTree creates a temporary directory holding the entries of spec, keyed by their path
+// relative to it with forward slashes, and returns its path. Parent directories are created as
+// needed, so nested entries don't need their own directory entries. The directory is removed
+// when the test or benchmark finishes, and it's skipped if symlinks can't be created.
+func makeTree(tb testing.TB, spec map[string]treeEntry) string {
+	tb.Helper()
+	root := tb.TempDir()
+	for name, entry := range spec {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		switch {
+		case entry.Dir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				tb.Fatal(err)
+			}
+		case entry.Link != "":
+			if err := os.Symlink(filepath.FromSlash(entry.Link), path); err != nil {
+				tb.Skipf("Symlinks can't be created here: %v", err)
+			}
+		default:
+			content := entry.Content
+			if content == "" && entry.Size > 0 {
+				content = strings.Repeat("a", entry.Size)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return root
+}
+
+// runTool runs the tool with args as if from the command line, returning what it printed to
+// stdout and the error run returned
+func runTool(tb testing.TB, args ...string) (string, error) {
+	tb.Helper()
+	cfg, err := parseFlags(args)
+	if err != nil {
+		tb.Fatalf("Parsing %v: %v", args, err)
+	}
+
+	var out string
+	err = captureStdout(tb, &out, func() error {
+		return run(context.Background(), cfg)
+	})
+	return out, err
+}
+
+// captureStdout calls f with os.Stdout redirected, storing what it printed in out
+func captureStdout(tb testing.TB, out *string, f func() error) error {
+	tb.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- string(data)
+	}()
+
+	err = f()
+	w.Close()
+	*out = <-printed
+	r.Close()
+	return err
+}
+
+// mustRunTool is runTool for runs that have to succeed
+func mustRunTool(tb testing.TB, args ...string) string {
+	tb.Helper()
+	out, err := runTool(tb, args...)
+	if err != nil {
+		tb.Fatalf("Running %v: %v", args, err)
+	}
+	return out
+}
+
+// indexedNames indexes root to a CSV index with the extra args and returns the names in it
+func indexedNames(tb testing.TB, root string, args ...string) []string {
+	tb.Helper()
+	output := filepath.Join(tb.TempDir(), "index.csv")
+	mustRunTool(tb, append([]string{"-i", "-d", root, "-o", output, "--sorted"}, args...)...)
+
+	columns, lines, err := readIndex(output, "csv", ',')
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var names []string
+	for _, line := range lines {
+		names = append(names, fileInfoFromRecord(columns, line).Name)
+	}
+	return names
+}
+
+func TestIndexThenSearch(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"report.txt":          {Content: "quarterly numbers\n"},
+		"docs/report-old.md":  {Content: "# Old report\n"},
+		"docs/notes.txt":      {Size: 2048},
+		"images/logo.bin":     {Content: "\x89PNG\x00\x00binary"},
+		"images/report-link":  {Link: "../report.txt"},
+		"empty-dir":           {Dir: true},
+		"src/deep/nested/a.c": {Content: "int main(void) { return 0; }\n"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		name  string
+		args  []string
+		paths []string
+	}{
+		{"substring", []string{"-s", "report"}, []string{"docs/report-old.md", "images/report-link", "report.txt"}},
+		{"ignore case", []string{"-s", "REPORT.TXT", "-I"}, []string{"report.txt"}},
+		{"nested", []string{"-s", "a.c"}, []string{"src/deep/nested/a.c"}},
+		{"no match", []string{"-s", "missing"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustRunTool(t, append([]string{"-o", output, "--sort", "path"}, tt.args...)...)
+			var paths []string
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				if line == "" {
+					continue
+				}
+				fields := strings.Split(line, "\t")
+				rel, err := filepath.Rel(root, fields[len(fields)-1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, filepath.ToSlash(rel))
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.paths, ",") {
+				t.Errorf("Got paths %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
+
+// benchmarkTree makes a tree of text and binary files, spread across nested directories
+func benchmarkTree(b *testing.B, files int) string {
+	spec := make(map[string]treeEntry, files)
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("dir%d/sub%d/file%d.txt", i%10, i%7, i)
+		entry := treeEntry{Size: 100 + i%4000}
+		if i%5 == 0 {
+			name = fmt.Sprintf("dir%d/sub%d/file%d.bin", i%10, i%7, i)
+			entry = treeEntry{Content: strings.Repeat("\x00\x01\x02\x03", 64+i%100)}
+		}
+		spec[name] = entry
+	}
+	return makeTree(b, spec)
+}
+
+// benchmarkConfig parses args into a config for the benchmarks to call indexFiles with
+func benchmarkConfig(b *testing.B, args ...string) *config {
+	cfg, err := parseFlags(args)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return cfg
+}
+
+func BenchmarkIndexFiles(b *testing.B) {
+	root := benchmarkTree(b, 1000)
+	benchmarks := []struct {
+		name string
+		args []string
+	}{
+		{"default", nil},
+		{"workers=1", []string{"-w", "1"}},
+		{"workers=4", []string{"-w", "4"}},
+		{"workers=16", []string{"-w", "16"}},
+		{"sniffed types", []string{"--fast-type=false"}},
+		{"fast types", []string{"--fast-type"}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			cfg := benchmarkConfig(b, append([]string{"-i", "-d", root}, bm.args...)...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := indexFiles(context.Background(), cfg, []string{root}, nil, func(FileInfo) {}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	root := benchmarkTree(b, 1000)
+	output := filepath.Join(b.TempDir(), "index.csv")
+	mustRunTool(b, "-i", "-d", root, "-o", output)
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	cfg := benchmarkConfig(b, "-o", output, "-s", "file12")
+	cfg.format = "csv"
+	cfg.delimiter = ','
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := search(cfg, cfg.searchTerms()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHumanizeSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1KB"},
+		{1536, "1.5KB"},
+		{1048575, "1MB"},
+		{1048576, "1MB"},
+		{1 << 30, "1GB"},
+		{1<<40 - 1, "1TB"},
+		{1 << 50, "1024TB"},
+	}
+	for _, tt := range tests {
+		if got := humanizeSize(tt.size); got != tt.want {
+			t.Errorf("humanizeSize(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"500", 500, true},
+		{"500KB", 500 << 10, true},
+		{"1.5gb", 3 << 29, true},
+		{" 10 MB ", 10 << 20, true},
+		{"2TB", 2 << 40, true},
+		{"", 0, false},
+		{"KB", 0, false},
+		{"ten", 0, false},
+		{"-1", 0, false},
+		{"-5MB", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-Inf", 0, false},
+		{"infinityKB", 0, false},
+		{"99999999TB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d and ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSQLiteSearchField(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"Report.txt": {Content: "a"},
+		"notes.md":   {Content: "b"},
+	})
+	dir := t.TempDir()
+	csvIndex := filepath.Join(dir, "index.csv")
+	sqliteIndex := filepath.Join(dir, "index.sqlite")
+	mustRunTool(t, "-i", "-d", root, "-o", csvIndex)
+	mustRunTool(t, "-i", "-d", root, "-o", sqliteIndex)
+
+	for _, field := range []string{"name", "Name", "NAME"} {
+		want := mustRunTool(t, "-o", csvIndex, "-s", "Report", "--field", field)
+		got := mustRunTool(t, "-o", sqliteIndex, "-s", "Report", "--field", field)
+		if got != want || got == "" {
+			t.Errorf("Searching --field %s: SQLite gave %q, CSV gave %q", field, got, want)
+		}
+	}
+}
+
+func TestSQLiteSearchMatchesCSV(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"Ärger.txt":    {Content: "a"},
+		"ärger-2.txt":  {Content: "b"},
+		"Report.TXT":   {Content: "c"},
+		"notes.md":     {Content: "d"},
+		"100%_done.md": {Content: "e"},
+	})
+	dir := t.TempDir()
+	csvIndex := filepath.Join(dir, "index.csv")
+	sqliteIndex := filepath.Join(dir, "index.sqlite")
+	mustRunTool(t, "-i", "-d", root, "-o", csvIndex)
+	mustRunTool(t, "-i", "-d", root, "-o", sqliteIndex)
+
+	tests := [][]string{
+		{"-s", "ärger", "-I"},
+		{"-s", "ÄRGER", "-I"},
+		{"-s", "report", "-I"},
+		{"-s", "Report"},
+		{"-s", "report"},
+		{"-s", "100%_"},
+		{"-s", ".md", "--match-mode", "suffix"},
+		{"-s", "REPORT.txt", "-I", "--field", "Name"},
+	}
+	for _, args := range tests {
+		want := mustRunTool(t, append([]string{"-o", csvIndex, "--sort", "path"}, args...)...)
+		got := mustRunTool(t, append([]string{"-o", sqliteIndex, "--sort", "path"}, args...)...)
+		if got != want {
+			t.Errorf("Searching %v: SQLite gave %q, CSV gave %q", args, got, want)
+		}
+	}
+}
+
+func TestServeAddressInUse(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{"a.txt": {Content: "a"}})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	_, err = runTool(t, "--serve", "--addr", taken.Addr().String(), "-o", output)
+	if exitCode(err) != exitFailure {
+		t.Errorf("Serving on a taken address gave %v, want exit code %d", err, exitFailure)
+	}
+}
+
+func TestFindNameDupes(t *testing.T) {
+	tests := []struct {
+		name  string
+		index string
+		want  string
+	}{
+		{
+			"different directories",
+			"Name,Size,Type,Path\nindex.html,1,text/html,a/index.html\nindex.html,1,text/html,b/index.html\nmain.go,1,text/plain,a/main.go\n",
+			"index.html\n  a/index.html\n  b/index.html\nShared: 1 names by 2 files\n",
+		},
+		{
+			"repeated paths",
+			"Name,Size,Type,Path\nindex.html,1,text/html,a/index.html\nmain.go,1,text/plain,a/main.go\nindex.html,1,text/html,a/index.html\nmain.go,1,text/plain,a/main.go\n",
+			"Shared: 0 names by 0 files\n",
+		},
+		{
+			"repeated and shared",
+			"Name,Size,Type,Path\nindex.html,1,text/html,a/index.html\nindex.html,1,text/html,a/index.html\nindex.html,1,text/html,b/index.html\n",
+			"index.html\n  a/index.html\n  b/index.html\nShared: 1 names by 2 files\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "index.csv")
+			if err := os.WriteFile(output, []byte(tt.index), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := mustRunTool(t, "--find-name-dupes", "-o", output); got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupeKeepsLayout(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"a.txt":     {Content: "a"},
+		"b, c.txt":  {Content: "b"},
+		"sub/d.txt": {Content: "d"},
+	})
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"csv", nil},
+		{"tab delimited", []string{"--delimiter", "tab"}},
+		{"semicolon delimited", []string{"--delimiter", ";"}},
+		{"no header", []string{"--no-header"}},
+		{"metadata", []string{"--metadata"}},
+		{"metadata and delimiter", []string{"--metadata", "--delimiter", "|"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "index.csv")
+			mustRunTool(t, append([]string{"-i", "-d", root, "-o", output, "--sorted"}, tt.args...)...)
+			original, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Append every file's row a second time. None of the files is called Name, so only
+			// the header starts with it.
+			var rows []string
+			for _, line := range strings.SplitAfter(string(original), "\n") {
+				if line == "" || strings.HasPrefix(line, csvCommentPrefix) || strings.HasPrefix(line, "Name") {
+					continue
+				}
+				rows = append(rows, line)
+			}
+			if err := os.WriteFile(output, []byte(string(original)+strings.Join(rows, "")), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := mustRunTool(t, "--dedupe", "-o", output), "Removed: 3 duplicates, kept 3 files\n"; got != want {
+				t.Errorf("Got %q, want %q", got, want)
+			}
+			deduped, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(deduped, original) {
+				t.Errorf("Deduped index is\n%s\nwant\n%s", deduped, original)
+			}
+		})
+	}
+
+	t.Run("json metadata", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "index.json")
+		mustRunTool(t, "-i", "-d", root, "-o", output, "--sorted", "--metadata")
+		original, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var index map[string]interface{}
+		if err := json.Unmarshal(original, &index); err != nil {
+			t.Fatal(err)
+		}
+		files := index["files"].([]interface{})
+		index["files"] = append(files, files...)
+		duplicated, err := json.Marshal(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(output, duplicated, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		mustRunTool(t, "--dedupe", "-o", output)
+		deduped, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(deduped, original) {
+			t.Errorf("Deduped index is\n%s\nwant\n%s", deduped, original)
+		}
+	})
+}
+
+func TestRichTypes(t *testing.T) {
+	// A docx is a zip archive recognized by its word/ entries, which a stored entry ahead of
+	// them pushes past the first 512 bytes
+	var docx bytes.Buffer
+	archive := zip.NewWriter(&docx)
+	for _, entry := range []struct{ name, content string }{
+		{"[Content_Types].xml", strings.Repeat("<Types/>", 100)},
+		{"word/document.xml", "<w:document/>"},
+	} {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := makeTree(t, map[string]treeEntry{
+		"report.docx": {Content: docx.String()},
+		"notes.txt":   {Content: "plain text\n"},
+	})
+	tests := []struct {
+		name  string
+		args  []string
+		types map[string]string
+	}{
+		{"standard library", nil, map[string]string{
+			"notes.txt":   "text/plain; charset=utf-8",
+			"report.docx": "application/zip",
+		}},
+		{"rich types", []string{"--rich-types"}, map[string]string{
+			"notes.txt":   "text/plain; charset=utf-8",
+			"report.docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		}},
+		{"rich types with few sniff bytes", []string{"--rich-types", "--sniff-bytes", "16"}, map[string]string{
+			"notes.txt":   "text/plain; charset=utf-8",
+			"report.docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "index.csv")
+			mustRunTool(t, append([]string{"-i", "-d", root, "-o", output}, tt.args...)...)
+			columns, lines, err := readIndex(output, "csv", ',')
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				fileInfo := fileInfoFromRecord(columns, line)
+				if want := tt.types[fileInfo.Name]; fileInfo.Type != want {
+					t.Errorf("%s has type %q, want %q", fileInfo.Name, fileInfo.Type, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexSmallFiles(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"three.txt": {Content: "abc"},
+		"empty.txt": {},
+		"one.bin":   {Content: "\x00"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	columns, lines, err := readIndex(output, "csv", ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		size        int64
+		contentType string
+	}{
+		"three.txt": {3, "text/plain; charset=utf-8"},
+		"empty.txt": {0, "text/plain; charset=utf-8"},
+		"one.bin":   {1, "application/octet-stream"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Indexed %d files, want %d", len(lines), len(want))
+	}
+	for _, line := range lines {
+		fileInfo := fileInfoFromRecord(columns, line)
+		if w := want[fileInfo.Name]; fileInfo.Size != w.size || fileInfo.Type != w.contentType {
+			t.Errorf("%s has size %d and type %q, want %d and %q", fileInfo.Name, fileInfo.Size, fileInfo.Type, w.size, w.contentType)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"keep.txt":                  {Content: "a"},
+		"scratch.tmp":               {Content: "b"},
+		"sub/more.tmp":              {Content: "c"},
+		"sub/keep.go":               {Content: "d"},
+		"node_modules/pkg/index.js": {Content: "e"},
+		"app.log":                   {Content: "f"},
+	})
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"none", nil, []string{"app.log", "index.js", "keep.go", "keep.txt", "more.tmp", "scratch.tmp"}},
+		{"tmp files", []string{"--exclude", "*.tmp"}, []string{"app.log", "index.js", "keep.go", "keep.txt"}},
+		{"directory", []string{"--exclude", "node_modules"}, []string{"app.log", "keep.go", "keep.txt", "more.tmp", "scratch.tmp"}},
+		{"comma-separated", []string{"--exclude", "*.tmp,*.log"}, []string{"index.js", "keep.go", "keep.txt"}},
+		{"repeated", []string{"--exclude", "*.tmp", "--exclude", "node_modules"}, []string{"app.log", "keep.go", "keep.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := indexedNames(t, root, tt.args...)
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Indexed %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexUnreadableFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, root string)
+	}{
+		{"permission denied", func(t *testing.T, root string) {
+			path := filepath.Join(root, "secret.txt")
+			if err := os.WriteFile(path, []byte("secret"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chmod(path, 0644) })
+			if file, err := os.Open(path); err == nil {
+				file.Close()
+				t.Skip("Files without read permission can still be read here, e.g. as root")
+			}
+		}},
+		{"dangling symlink", func(t *testing.T, root string) {
+			if err := os.Symlink(filepath.Join(root, "missing.txt"), filepath.Join(root, "secret.txt")); err != nil {
+				t.Skipf("Symlinks can't be created here: %v", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := makeTree(t, map[string]treeEntry{
+				"a.txt":     {Content: "a"},
+				"sub/b.txt": {Content: "b"},
+				"z.txt":     {Content: "z"},
+			})
+			tt.setup(t, root)
+
+			names := indexedNames(t, root)
+			if want := []string{"a.txt", "b.txt", "z.txt"}; strings.Join(names, ",") != strings.Join(want, ",") {
+				t.Errorf("Indexed %v, want %v", names, want)
+			}
+		})
+	}
+}
+
+func TestLooksBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"ascii", []byte("plain text\n"), false},
+		{"utf-8", []byte("naïve café, 日本語, emoji 🙂\n"), false},
+		{"nul at start", []byte("\x00ELF"), true},
+		{"embedded nul", []byte("text\x00more text"), true},
+		{"nul at end", []byte("text\x00"), true},
+		{"control characters", []byte("\x1b[31mred\x1b[0m\t\r\n"), false},
+	}
+	for _, tt := range tests {
+		if got := looksBinary(tt.data); got != tt.want {
+			t.Errorf("looksBinary(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentSearchSkipsBinary(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"notes.txt":  {Content: "the needle is here\n"},
+		"binary.txt": {Content: "needle\x00\x01\x02"},
+		"other.txt":  {Content: "nothing to see\n"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"text only", nil, []string{"notes.txt"}},
+		{"content-all", []string{"--content-all"}, []string{"binary.txt", "notes.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustRunTool(t, append([]string{"-o", output, "--content", "-s", "needle"}, tt.args...)...)
+			var names []string
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				if line != "" {
+					names = append(names, filepath.Base(strings.SplitN(line, ":", 2)[0]))
+				}
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Matched %v, want %v (output %q)", names, tt.want, out)
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"top.txt":         {Content: "a"},
+		"one/mid.txt":     {Content: "b"},
+		"one/two/low.txt": {Content: "c"},
+	})
+	tests := []struct {
+		depth string
+		want  []string
+	}{
+		{"0", []string{"top.txt"}},
+		{"1", []string{"mid.txt", "top.txt"}},
+		{"2", []string{"low.txt", "mid.txt", "top.txt"}},
+		{"-1", []string{"low.txt", "mid.txt", "top.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.depth, func(t *testing.T) {
+			names := indexedNames(t, root, "--max-depth", tt.depth)
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Indexed %v, want %v", names, tt.want)
+			}
+		})
+	}
+
+	if _, err := runTool(t, "-i", "-d", root, "-o", filepath.Join(t.TempDir(), "index.csv"), "--max-depth", "-2"); exitCode(err) != exitUsage {
+		t.Errorf("A max depth of -2 gave %v, want exit code %d", err, exitUsage)
+	}
+}
+
+func TestVCSDirectories(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		".gitignore":         {Content: "*.log\n"},
+		".github/ci.yml":     {Content: "on: push\n"},
+		".gitlab/ci.yml":     {Content: "stages: []\n"},
+		".git/config":        {Content: "[core]\n"},
+		".git/objects/ab/cd": {Content: "blob"},
+		".hg/store":          {Content: "hg"},
+		".svn/entries":       {Content: "svn"},
+		"sub/.git":           {Content: "gitdir: ../.git/modules/sub\n"},
+		"sub/main.go":        {Content: "package main\n"},
+	})
+	names := indexedNames(t, root)
+	sort.Strings(names)
+	if want := []string{".gitignore", "ci.yml", "ci.yml", "main.go"}; strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("Indexed %v, want %v", names, want)
+	}
+}
+
+func TestCSVAwkwardNames(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		`report, final.txt`:      {Content: "a"},
+		`say "hello".txt`:        {Content: "b"},
+		`dir, with "both"/x.txt`: {Content: "c"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{", final", "report, final.txt"},
+		{`"hello"`, `say "hello".txt`},
+		{"x.txt", "x.txt"},
+	}
+	for _, tt := range tests {
+		out := mustRunTool(t, "-o", output, "-s", tt.query, "--result-format", "json")
+		var files []FileInfo
+		if err := json.Unmarshal([]byte(out), &files); err != nil {
+			t.Fatalf("Searching %q gave invalid JSON %q: %v", tt.query, out, err)
+		}
+		if len(files) != 1 || files[0].Name != tt.want {
+			t.Errorf("Searching %q found %v, want %q", tt.query, files, tt.want)
+		}
+	}
+	out := mustRunTool(t, "-o", output, "-s", "both", "--field", "path", "--result-format", "json")
+	if !strings.Contains(out, `dir, with \"both\"`) {
+		t.Errorf("Searching the path for both gave %q", out)
+	}
+}
+
+func TestCSVMalformedRows(t *testing.T) {
+	index := strings.Join([]string{
+		"Name,Size,Type,Path",
+		"good.txt,1,text/plain,dir/good.txt",
+		"short.txt,1",
+		"",
+		"long.txt,1,text/plain,dir/long.txt,extra",
+		`bad"quote.txt,1,text/plain,"dir/bad`,
+		"also-good.txt,2,text/plain,dir/also-good.txt",
+	}, "\n") + "\n"
+	output := filepath.Join(t.TempDir(), "index.csv")
+	if err := os.WriteFile(output, []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := mustRunTool(t, "-o", output, "-s", ".txt", "--sort", "name")
+	want := "also-good.txt\t2\ttext/plain\tdir/also-good.txt\ngood.txt\t1\ttext/plain\tdir/good.txt\n"
+	if out != want {
+		t.Errorf("Got %q, want %q", out, want)
+	}
+}
+
+func TestFileCategory(t *testing.T) {
+	tests := []struct {
+		name, contentType, want string
+	}{
+		{"main.go", "text/plain; charset=utf-8", "code"},
+		{"README.MD", "text/plain; charset=utf-8", "documents"},
+		{"report.pdf", "application/pdf", "documents"},
+		{"letter", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "documents"},
+		{"photo.jpg", "image/jpeg", "images"},
+		{"icon", "image/png", "images"},
+		{"clip.mp4", "video/mp4", "video"},
+		{"song.mp3", "audio/mpeg", "audio"},
+		{"backup.tar.gz", "application/x-gzip", "archives"},
+		{"bundle", "application/zip", "archives"},
+		{"data.bin", "application/octet-stream", "other"},
+		{"notes", "text/plain; charset=utf-8", "documents"},
+		{"index", "text/html; charset=utf-8", "code"},
+		{"script", "text/x-python", "code"},
+		{"config", "application/json", "code"},
+	}
+	for _, tt := range tests {
+		if got := fileCategory(tt.name, tt.contentType); got != tt.want {
+			t.Errorf("fileCategory(%q, %q) = %q, want %q", tt.name, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestSearchCategory(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"photo.png": {Content: "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"},
+		"main.go":   {Content: "package main\n"},
+		"notes.txt": {Content: "notes\n"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"images", []string{"photo.png"}},
+		{"code", []string{"main.go"}},
+		{"documents", []string{"notes.txt"}},
+		{"video", nil},
+	}
+	for _, tt := range tests {
+		out := mustRunTool(t, "-o", output, "--field", "category", "-s", tt.query, "--sort", "name")
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line != "" {
+				names = append(names, strings.Split(line, "\t")[0])
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Searching category %s found %v, want %v", tt.query, names, tt.want)
+		}
+	}
+}
+
+func TestDirectoryMisuse(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{"file.txt": {Content: "a"}})
+	tests := []struct {
+		name      string
+		directory string
+	}{
+		{"regular file", filepath.Join(root, "file.txt")},
+		{"missing", filepath.Join(root, "missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An existing index must be left as it was rather than truncated
+			output := filepath.Join(t.TempDir(), "index.csv")
+			existing := "Name,Size,Type,Path\nold.txt,1,text/plain,old.txt\n"
+			if err := os.WriteFile(output, []byte(existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := runTool(t, "-i", "-d", tt.directory, "-o", output)
+			if exitCode(err) != exitWalk {
+				t.Errorf("Indexing got %v, want exit code %d", err, exitWalk)
+			}
+			if data, err := os.ReadFile(output); err != nil || string(data) != existing {
+				t.Errorf("Existing index is now %q, %v", data, err)
+			}
+		})
+	}
+
+	t.Run("output inside directory", func(t *testing.T) {
+		root := makeTree(t, map[string]treeEntry{"file.txt": {Content: "a"}})
+		output := filepath.Join(root, "index.csv")
+		for run := 1; run <= 2; run++ {
+			mustRunTool(t, "-i", "-d", root, "-o", output)
+			_, lines, err := readIndex(output, "csv", ',')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) != 1 || lines[0][0] != "file.txt" {
+				t.Errorf("Run %d indexed %v, want only file.txt", run, lines)
+			}
+		}
+	})
+}
+
+func TestNormalizeSearch(t *testing.T) {
+	// Two accented names, one stored decomposed as macOS does and the other precomposed
+	decomposed := "cafe\u0301.txt"
+	precomposed := "r\u00e9sum\u00e9.txt"
+	root := makeTree(t, map[string]treeEntry{
+		decomposed:  {Content: "a"},
+		precomposed: {Content: "b"},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		name  string
+		query string
+		args  []string
+		want  string
+	}{
+		{"precomposed query without normalize", "caf\u00e9", nil, ""},
+		{"precomposed query", "caf\u00e9", []string{"--normalize"}, decomposed},
+		{"decomposed query without normalize", "re\u0301sume\u0301", nil, ""},
+		{"decomposed query", "re\u0301sume\u0301", []string{"--normalize"}, precomposed},
+		{"ignoring case", "CAF\u00c9", []string{"--normalize", "-I"}, decomposed},
+		{"matching form", "cafe\u0301", nil, decomposed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := mustRunTool(t, append([]string{"-o", output, "-s", tt.query}, tt.args...)...)
+			got := ""
+			if out != "" {
+				got = strings.Split(out, "\t")[0]
+			}
+			if got != tt.want {
+				t.Errorf("Found %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSizeComparison(t *testing.T) {
+	tests := []struct {
+		query   string
+		size    string
+		matches bool
+	}{
+		{">1MB", "1048577", true},
+		{">1MB", "1048576", false},
+		{">=1MB", "1048576", true},
+		{">=1MB", "1048575", false},
+		{"<1KB", "1023", true},
+		{"<1KB", "1024", false},
+		{"<=1KB", "1024", true},
+		{"<=1KB", "1025", false},
+		{"=0", "0", true},
+		{"=0", "1", false},
+		{"size>500", "501", true},
+		{"SIZE <= 500KB", "512000", true},
+		{"size>=1.5KB", "1535", false},
+		{">1MB", "not a size", false},
+	}
+	for _, tt := range tests {
+		compare, ok := parseSizeComparison(tt.query)
+		if !ok {
+			t.Errorf("parseSizeComparison(%q) isn't a comparison", tt.query)
+			continue
+		}
+		if got := compare(tt.size); got != tt.matches {
+			t.Errorf("%q against %s = %v, want %v", tt.query, tt.size, got, tt.matches)
+		}
+	}
+
+	for _, query := range []string{"1MB", "size", ">", ">=lots", "~1MB", "sizes>1"} {
+		if _, ok := parseSizeComparison(query); ok {
+			t.Errorf("parseSizeComparison(%q) is a comparison", query)
+		}
+	}
+}
+
+func TestSearchSizeComparison(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"small.txt": {Size: 1023},
+		"kb.txt":    {Size: 1024},
+		"large.txt": {Size: 2048},
+	})
+	output := filepath.Join(t.TempDir(), "index.csv")
+	mustRunTool(t, "-i", "-d", root, "-o", output)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{">1KB", []string{"large.txt"}},
+		{">=1KB", []string{"kb.txt", "large.txt"}},
+		{"size<1KB", []string{"small.txt"}},
+		{"=1024", []string{"kb.txt"}},
+	}
+	for _, tt := range tests {
+		out := mustRunTool(t, "-o", output, "--field", "size", "-s", tt.query, "--sort", "name")
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line != "" {
+				names = append(names, strings.Split(line, "\t")[0])
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Searching size %s found %v, want %v", tt.query, names, tt.want)
+		}
+	}
+}
+
+func TestIndexSkipsItself(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"a.txt":                 {Content: "a"},
+		"index.csv":             {Content: "Name,Size,Type,Path\nold.txt,1,text/plain,old.txt\n"},
+		"index.csv.1234.tmp":    {Content: "left over from a crash"},
+		"other-index.csv":       {Content: "Name,Size,Type,Path\n"},
+		"sub/index.csv":         {Content: "not the index\n"},
+		"index.csv.backup":      {Content: "kept\n"},
+		"index.csv.1234.tmp.gz": {Content: "not a temporary file\n"},
+	})
+	names := func(output string) []string {
+		mustRunTool(t, "-i", "-d", root, "-o", output, "--sorted")
+		columns, lines, err := readIndex(output, "csv", ',')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, line := range lines {
+			rel, err := filepath.Rel(root, fileInfoFromRecord(columns, line).Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return names
+	}
+
+	want := []string{"a.txt", "index.csv.1234.tmp.gz", "index.csv.backup", "other-index.csv", "sub/index.csv"}
+	if got := names(filepath.Join(root, "index.csv")); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Indexed %v, want %v", got, want)
+	}
+
+	// The same file given by a relative path is still recognized
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, filepath.Join(root, "index.csv"))
+	if err != nil {
+		t.Skipf("The index has no path relative to the working directory: %v", err)
+	}
+	if got := names(relative); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Indexed %v with a relative output, want %v", got, want)
+	}
+}
+
+func TestSkipType(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"photo.png":  {Content: "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"},
+		"anim.gif":   {Content: "GIF89a\x01\x00\x01\x00"},
+		"notes.txt":  {Content: "notes\n"},
+		"page.html":  {Content: "<!DOCTYPE html><html></html>"},
+		"data.bin":   {Content: "\x00\x01\x02\x03"},
+		"sound.wav":  {Content: "RIFF\x24\x00\x00\x00WAVEfmt "},
+		"empty.file": {},
+	})
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"none", nil, []string{"anim.gif", "data.bin", "empty.file", "notes.txt", "page.html", "photo.png", "sound.wav"}},
+		{"images", []string{"--skip-type", "image/"}, []string{"data.bin", "empty.file", "notes.txt", "page.html", "sound.wav"}},
+		{"one image type", []string{"--skip-type", "image/png"}, []string{"anim.gif", "data.bin", "empty.file", "notes.txt", "page.html", "sound.wav"}},
+		{"ignoring case", []string{"--skip-type", "IMAGE/"}, []string{"data.bin", "empty.file", "notes.txt", "page.html", "sound.wav"}},
+		{"several", []string{"--skip-type", "image/,text/", "--skip-type", "audio/"}, []string{"data.bin"}},
+		{"whole type", []string{"--skip-type", "application/octet-stream"}, []string{"anim.gif", "empty.file", "notes.txt", "page.html", "photo.png", "sound.wav"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := indexedNames(t, root, tt.args...)
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Indexed %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortedIndexIsReproducible(t *testing.T) {
+	spec := map[string]treeEntry{}
+	for i := 0; i < 200; i++ {
+		spec[fmt.Sprintf("dir%02d/file%03d.txt", i%17, i)] = treeEntry{Content: strings.Repeat("x", i)}
+	}
+	spec["links/first"] = treeEntry{Link: "../dir00/file000.txt"}
+	spec["empty"] = treeEntry{Dir: true}
+	root := makeTree(t, spec)
+
+	for _, format := range []string{"csv", "json", "ndjson", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			var outputs [2][]byte
+			for i, workers := range []string{"1", "8"} {
+				output := filepath.Join(t.TempDir(), "index."+format)
+				mustRunTool(t, "-i", "-d", root, "-o", output, "--sorted", "-w", workers)
+				data, err := os.ReadFile(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs[i] = data
+			}
+			if !bytes.Equal(outputs[0], outputs[1]) {
+				t.Errorf("Sorted %s index with 1 worker differs from the one with 8 workers", format)
+			}
+		})
+	}
+}
+
+func TestNormalizeType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"text/plain", "text/plain"},
+		{"Text/Plain", "text/plain"},
+		{"text/plain;charset=UTF-8", "text/plain; charset=utf-8"},
+		{"text/plain ;  charset=utf-8 ", "text/plain; charset=utf-8"},
+		{" image/PNG ", "image/png"},
+		{"multipart/form-data; boundary=X; charset=utf-8", "multipart/form-data; boundary=x; charset=utf-8"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeType(tt.contentType); got != tt.want {
+			t.Errorf("normalizeType(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestSearchType(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "index.csv")
+	index := "Name,Size,Type,Path\n" +
+		"notes.txt,6,text/plain; charset=utf-8,notes.txt\n" +
+		"old.txt,6,Text/Plain;Charset=UTF-8,old.txt\n" +
+		"photo.png,16,image/png,photo.png\n"
+	if err := os.WriteFile(output, []byte(index), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"Text/Plain;charset=UTF-8", []string{"notes.txt", "old.txt"}},
+		{"text/plain ; charset=utf-8", []string{"notes.txt", "old.txt"}},
+		{"TEXT/", []string{"notes.txt", "old.txt"}},
+		{"Image/PNG", []string{"photo.png"}},
+		{"text/html", nil},
+	}
+	for _, tt := range tests {
+		out := mustRunTool(t, "-o", output, "--field", "type", "-s", tt.query, "--sort", "name")
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line != "" {
+				names = append(names, strings.Split(line, "\t")[0])
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Searching type %s found %v, want %v", tt.query, names, tt.want)
+		}
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"empty.txt":        {},
+		"one-byte.txt":     {Content: "a"},
+		"newline.txt":      {Content: "\n"},
+		"nested/empty.log": {},
+		"nested/data.bin":  {Size: 4096},
+		"empty-dir":        {Dir: true},
+	})
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"kept", nil, []string{"empty.txt", "data.bin", "empty.log", "newline.txt", "one-byte.txt"}},
+		{"skipped", []string{"--skip-empty"}, []string{"data.bin", "newline.txt", "one-byte.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := indexedNames(t, root, tt.args...)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Indexed %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchWithoutMain(t *testing.T) {
+	// main never runs under go test, so this is the logger the package starts with
+	if log == nil {
+		t.Fatal("Global logger is nil before main sets it")
+	}
+
+	index := "Name,Size,Type,Path\nkeep.txt,1,text/plain,keep.txt\nshort.txt,1\n"
+	output := filepath.Join(t.TempDir(), "index.csv")
+	if err := os.WriteFile(output, []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseFlags([]string{"-o", output, "-f", "csv", "-s", ".txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Searching the malformed row logs a warning through the starting logger without panicking
+	var out string
+	var matches int
+	err = captureStdout(t, &out, func() error {
+		var err error
+		matches, err = search(cfg, cfg.searchTerms())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches != 1 || out != "keep.txt\t1\ttext/plain\tkeep.txt\n" {
+		t.Errorf("Got %d matches printing %q, want only keep.txt", matches, out)
+	}
+
+	// The same warning reaches a logger swapped in afterwards
+	core, logs := observer.New(zap.WarnLevel)
+	defer func(previous *zap.SugaredLogger) { log = previous }(log)
+	log = zap.New(core).Sugar()
+	if err := captureStdout(t, &out, func() error {
+		_, err := search(cfg, cfg.searchTerms())
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterMessageSnippet("wrong number of columns").Len() != 1 {
+		t.Errorf("Logged %v, want one warning about the short row", logs.All())
+	}
+}
+
+func TestMetadataCommentNames(t *testing.T) {
+	root := makeTree(t, map[string]treeEntry{
+		"# notes.txt":              {Content: "a"},
+		"# index-search notes.txt": {Content: "b"},
+	})
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"header", nil},
+		{"no header", []string{"--no-header"}},
+		{"metadata", []string{"--metadata"}},
+		{"metadata without header", []string{"--metadata", "--no-header"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "index.csv")
+			mustRunTool(t, append([]string{"-i", "-d", root, "-o", output}, tt.args...)...)
+
+			out := mustRunTool(t, "-o", output, "-s", "notes", "--sort", "name", "--result-format", "json")
+			var files []FileInfo
+			if err := json.Unmarshal([]byte(out), &files); err != nil {
+				t.Fatalf("Searching gave invalid JSON %q: %v", out, err)
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name)
+			}
+			if want := "# index-search notes.txt,# notes.txt"; strings.Join(names, ",") != want {
+				t.Errorf("Found %v, want %s", names, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// filePerms returns the permission bits of the file described by info in octal. Files have no
+// Unix owner on this platform, so the user and group IDs are always empty.
+func filePerms(info os.FileInfo) (mode, uid, gid string) {
+	return fileMode(info.Mode()), "", ""
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// filePerms returns the permission bits of the file described by info in octal, along with the
+// user and group IDs of its owner
+func filePerms(info os.FileInfo) (mode, uid, gid string) {
+	mode = fileMode(info.Mode())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid = strconv.FormatUint(uint64(stat.Uid), 10)
+		gid = strconv.FormatUint(uint64(stat.Gid), 10)
+	}
+	return mode, uid, gid
+}